@@ -0,0 +1,187 @@
+/* Access control lists: named lists of IP prefixes, required by a
+   listener, a zone or an operation.
+
+   The file has one directive per line:
+
+   acl NAME [!]PREFIX...      A list, the first matching prefix decides
+                              ("!" denies), no match denies
+   listener TRANSPORT NAME    udp, tcp, tls, https or http
+   zone ZONE NAME             The zone and everything below
+   operation OPERATION NAME   query, axfr, ixfr, notify or update
+   action refused|drop        What to do with denied queries
+
+   A query must be allowed by every ACL which applies to it: the one of
+   its listener, the one of the most specific zone and the one of its
+   operation.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package acl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"./prefix"
+)
+
+type entry struct {
+	prefix  prefix.Prefix
+	negated bool
+}
+
+type ACL struct {
+	Name    string
+	entries []entry
+}
+
+type Rules struct {
+	Drop       bool // Else, reply REFUSED
+	listeners  map[string]*ACL
+	zones      map[string]*ACL
+	operations map[string]*ACL
+}
+
+var (
+	transports = map[string]bool{"udp": true, "tcp": true, "tls": true, "https": true, "http": true}
+	operations = map[string]bool{"query": true, "axfr": true, "ixfr": true, "notify": true, "update": true}
+)
+
+func (acl *ACL) Allows(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, entry := range acl.entries {
+		if entry.prefix.Contains(ip) {
+			return !entry.negated
+		}
+	}
+	return false
+}
+
+func canonical(name string) string {
+	name = strings.ToLower(name)
+	if name != "." && strings.HasSuffix(name, ".") {
+		name = name[0 : len(name)-1]
+	}
+	return name
+}
+
+func Read(filename string) (rules *Rules, error os.Error) {
+	content, error := ioutil.ReadFile(filename)
+	if error != nil {
+		return nil, error
+	}
+	acls := make(map[string]*ACL)
+	rules = &Rules{listeners: make(map[string]*ACL), zones: make(map[string]*ACL),
+		operations: make(map[string]*ACL)}
+	// The ACLs may be used before being defined, so they are
+	// resolved at the end
+	type use struct {
+		table   map[string]*ACL
+		key     string
+		name    string
+		linenum int
+	}
+	lines := strings.Split(string(content), "\n", -1)
+	uses := make([]use, 0, len(lines))
+	for linenum, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		where := fmt.Sprintf("%s:%d", filename, linenum+1)
+		switch fields[0] {
+		case "acl":
+			if len(fields) < 2 {
+				return nil, os.NewError(where + ": acl without a name")
+			}
+			acl := &ACL{Name: fields[1], entries: make([]entry, len(fields)-2)}
+			for i, text := range fields[2:] {
+				negated := strings.HasPrefix(text, "!")
+				if negated {
+					text = text[1:]
+				}
+				parsed, error := prefix.Parse(text)
+				if error != nil {
+					return nil, os.NewError(fmt.Sprintf("%s: %s", where, error))
+				}
+				acl.entries[i] = entry{parsed, negated}
+			}
+			acls[acl.Name] = acl
+		case "listener", "zone", "operation":
+			if len(fields) != 3 {
+				return nil, os.NewError(fmt.Sprintf("%s: %s requires two arguments", where, fields[0]))
+			}
+			key := fields[1]
+			var table map[string]*ACL
+			switch fields[0] {
+			case "listener":
+				if !transports[key] {
+					return nil, os.NewError(fmt.Sprintf("%s: unknown listener %s", where, key))
+				}
+				table = rules.listeners
+			case "zone":
+				key = canonical(key)
+				table = rules.zones
+			case "operation":
+				if !operations[key] {
+					return nil, os.NewError(fmt.Sprintf("%s: unknown operation %s", where, key))
+				}
+				table = rules.operations
+			}
+			uses = uses[0 : len(uses)+1]
+			uses[len(uses)-1] = use{table, key, fields[2], linenum}
+		case "action":
+			if len(fields) != 2 || (fields[1] != "refused" && fields[1] != "drop") {
+				return nil, os.NewError(where + ": action must be refused or drop")
+			}
+			rules.Drop = fields[1] == "drop"
+		default:
+			return nil, os.NewError(fmt.Sprintf("%s: unknown directive %s", where, fields[0]))
+		}
+	}
+	for _, u := range uses {
+		acl, exists := acls[u.name]
+		if !exists {
+			return nil, os.NewError(fmt.Sprintf("%s:%d: unknown acl %s", filename, u.linenum+1, u.name))
+		}
+		u.table[u.key] = acl
+	}
+	return rules, nil
+}
+
+// The ACL of the most specific zone containing qname, nil if none
+func (rules *Rules) zone(qname string) *ACL {
+	for {
+		acl, exists := rules.zones[qname]
+		if exists {
+			return acl
+		}
+		if qname == "." {
+			return nil
+		}
+		dot := strings.Index(qname, ".")
+		if dot < 0 {
+			qname = "."
+		} else {
+			qname = qname[dot+1:]
+		}
+	}
+	return nil // Never reached
+}
+
+// Checks a query. If it is denied, returns the name of the ACL which
+// denied it.
+func (rules *Rules) Check(client net.IP, transport string, qname string, operation string) (allowed bool, denier string) {
+	for _, acl := range []*ACL{rules.listeners[transport], rules.zone(qname), rules.operations[operation]} {
+		if acl != nil && !acl.Allows(client) {
+			return false, acl.Name
+		}
+	}
+	return true, ""
+}
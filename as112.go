@@ -6,26 +6,59 @@ Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
 
  grong -servername "grong.cloud.as112.test" -- -email toto.example.net -hostname me.as112.net -location "In the cloud"
 
+It serves the zones of RFC 7534 (the original AS112, delegated to
+blackhole-1.iana.org and blackhole-2.iana.org), the zone
+empty.as112.arpa of RFC 7535 (the target of DNAME records, for the
+new AS112) and the zones hostname.as112.net and hostname.as112.arpa,
+which describe this node.
+
+Since the point of AS112 is to measure the leaked queries, it can keep
+statistics (per zone, per query type, and the top clients and names)
+and write them periodically to a file, in JSON:
+
+ grong -servername "grong.cloud.as112.test" -- -hostname me.as112.net -statsfile /var/lib/grong/as112.json
+
 */
 
 package responder
 
 import (
-	"regexp"
+	"io/ioutil"
+	"json"
+	"net"
 	"strings"
+	"sync"
+	"time"
 	"fmt"
 	"os"
+	"./metrics"
+	"./spacesaving"
 	"./types"
 	"./myflag"
 )
 
-const as112Regexp = "(168\\.192\\.in-addr\\.arpa|154\\.169\\.in-addr\\.arpa|16\\.172\\.in-addr\\.arpa|17\\.172\\.in-addr\\.arpa|18\\.172\\.in-addr\\.arpa|19\\.172\\.in-addr\\.arpa|20\\.172\\.in-addr\\.arpa|21\\.172\\.in-addr\\.arpa|22\\.172\\.in-addr\\.arpa|23\\.172\\.in-addr\\.arpa|24\\.172\\.in-addr\\.arpa|25\\.172\\.in-addr\\.arpa|26\\.172\\.in-addr\\.arpa|27\\.172\\.in-addr\\.arpa|28\\.172\\.in-addr\\.arpa|29\\.172\\.in-addr\\.arpa|30\\.172\\.in-addr\\.arpa|31\\.172\\.in-addr\\.arpa|10\\.in-addr\\.arpa)$"
+// The zones of RFC 1918 and RFC 3927, used when no -zones option is
+// given
+var defaultZones = []string{
+	"10.in-addr.arpa",
+	"16.172.in-addr.arpa", "17.172.in-addr.arpa", "18.172.in-addr.arpa",
+	"19.172.in-addr.arpa", "20.172.in-addr.arpa", "21.172.in-addr.arpa",
+	"22.172.in-addr.arpa", "23.172.in-addr.arpa", "24.172.in-addr.arpa",
+	"25.172.in-addr.arpa", "26.172.in-addr.arpa", "27.172.in-addr.arpa",
+	"28.172.in-addr.arpa", "29.172.in-addr.arpa", "30.172.in-addr.arpa",
+	"31.172.in-addr.arpa",
+	"168.192.in-addr.arpa",
+	"254.169.in-addr.arpa",
+}
 
 const defaultTTL = 3600
 
 var (
-	as112Domain    = regexp.MustCompile("^" + as112Regexp)
-	as112SubDomain = regexp.MustCompile("\\." + as112Regexp)
+	// The zones sunk by this node, indexed by their apex. Replaced
+	// as a whole by Reload, under sinkMutex.
+	sinkZones = make(map[string]bool)
+	sinkMutex sync.RWMutex
+
 	// Answers to "TXT hostname.as112.net"
 	hostnameAnswers = [...]string{
 		"Unknown location on Earth.",
@@ -33,12 +66,17 @@ var (
 		"See http://as112.net/ for more information.",
 	}
 
-	// Name servers of AS112, currently two
-	as112nameServers = [...]string{
+	// Name servers of the original AS112, RFC 7534, section 3.4
+	as112nameServers = []string{
 		"blackhole-1.iana.org",
 		"blackhole-2.iana.org",
 	}
 
+	// Name server of the DNAME-based AS112, RFC 7535, section 3.2
+	emptyNameServers = []string{
+		"blackhole.as112.arpa",
+	}
+
 	hostnamesoa = types.SOArecord{
 		Mname:   "NOT-CONFIGURED-use-hostname-option.as112.example.net", // Put the real hostname with the -hostname command-line option. We do not use -server which has lightly different semantics.
 		Rname:   "UNKNOWN-use-email-option.as112.example.net",           // Put your email address (with @ replaced by .) with the -email command-line option
@@ -49,20 +87,73 @@ var (
 		Minimum: 15,
 	}
 
+	// RFC 7534, section 3.4
 	as112soa = types.SOArecord{
 		Mname:   "prisoner.iana.org",
 		Rname:   "hostmaster.root-servers.org",
-		Serial:  2002040800,
-		Refresh: 1800,
-		Retry:   900,
+		Serial:  1,
+		Refresh: 604800,
+		Retry:   60,
+		Expire:  604800,
+		Minimum: 604800,
+	}
+
+	// RFC 7535, section 3.2
+	emptysoa = types.SOArecord{
+		Mname:   "blackhole.as112.arpa",
+		Rname:   "noc.dns.icann.org",
+		Serial:  1,
+		Refresh: 604800,
+		Retry:   60,
 		Expire:  604800,
 		Minimum: 604800,
 	}
 )
 
-func nsRecords(domain string) (result []types.RR) {
-	result = make([]types.RR, len(as112nameServers))
-	for i, text := range as112nameServers {
+// A zone served by the AS112 node
+type as112Zone struct {
+	soa         *types.SOArecord
+	nameServers []string
+	hostname    bool // Has the TXT records describing this node
+}
+
+var (
+	// The zones we serve, besides the sink zones
+	specialZones = map[string]as112Zone{
+		"hostname.as112.net":  as112Zone{&hostnamesoa, as112nameServers, true},
+		"hostname.as112.arpa": as112Zone{&hostnamesoa, emptyNameServers, true},
+		// The target of the DNAME records, RFC 7535, section 3.1
+		"empty.as112.arpa": as112Zone{&emptysoa, emptyNameServers, false},
+	}
+	sinkZone = as112Zone{&as112soa, as112nameServers, false}
+)
+
+// Returns the zone which contains the name, and its apex, by looking
+// up the name and then its ancestors
+func findZone(qname string) (apex string, zone as112Zone, found bool) {
+	sinkMutex.RLock()
+	sinks := sinkZones
+	sinkMutex.RUnlock()
+	for apex = qname; ; {
+		zone, found = specialZones[apex]
+		if found {
+			return
+		}
+		if sinks[apex] {
+			return apex, sinkZone, true
+		}
+		dot := strings.Index(apex, ".")
+		if dot == -1 {
+			return "", zone, false
+		}
+		apex = apex[dot+1:]
+	}
+	return // Never reached
+}
+
+func nsRecords(domain string, nameServers []string) (result []types.RR) {
+	result = make([]types.RR, len(nameServers))
+	for i, text := range nameServers {
 		result[i] = types.RR{
 			Name:  domain,
 			TTL:   defaultTTL,
@@ -85,56 +176,251 @@ func soaRecord(domain string, soa types.SOArecord) (result types.RR) {
 	return
 }
 
+// The SOA record for the authority section of negative answers, with
+// the negative TTL of RFC 2308, section 5
+func negativeSoa(domain string, soa types.SOArecord) (result types.RR) {
+	result = soaRecord(domain, soa)
+	if soa.Minimum < result.TTL {
+		result.TTL = soa.Minimum
+	}
+	return
+}
+
+func txtRecords(qname string) (result []types.RR) {
+	result = make([]types.RR, len(hostnameAnswers))
+	for i, text := range hostnameAnswers {
+		result[i] = types.RR{
+			Name:  qname,
+			TTL:   defaultTTL,
+			Type:  types.TXT,
+			Class: types.IN,
+			Data:  types.ToTXT(text),
+		}
+	}
+	return
+}
+
+func concat(section []types.RR, rrs []types.RR) []types.RR {
+	result := make([]types.RR, len(section)+len(rrs))
+	copy(result, section)
+	copy(result[len(section):], rrs)
+	return result
+}
+
+// Counters of the queries received. The number of zones and of
+// types is small but clients and names are counted with the
+// space-saving algorithm to keep memory bounded.
+type statistics struct {
+	mutex   sync.Mutex
+	start   int64
+	queries uint64
+	refused uint64
+	zones   map[string]uint64
+	qtypes  map[string]uint64
+	talkers *spacesaving.Summary // Per client prefix
+	names   *spacesaving.Summary
+}
+
+// What is written in the statistics file
+type statisticsReport struct {
+	Node       string
+	Start, End int64 // Seconds since the epoch
+	Queries    uint64
+	Refused    uint64
+	Zones      map[string]uint64
+	Qtypes     map[string]uint64
+	TopTalkers []spacesaving.Item
+	TopNames   []spacesaving.Item
+}
+
+// Exported even without -statsfile, if the server has -metrics. The
+// responses from the cache of the server are not counted.
+var zoneMetric = metrics.NewCounter("grong_as112_queries_total",
+	"Queries received by the AS112 responder, per zone (\"\" for the refused ones)", "zone")
+
+var (
+	stats *statistics // nil if we do not keep statistics
+	topN  int
+)
+
+func newStatistics(capacity int) *statistics {
+	return &statistics{start: time.Seconds(),
+		zones: make(map[string]uint64), qtypes: make(map[string]uint64),
+		talkers: spacesaving.New(capacity), names: spacesaving.New(capacity)}
+}
+
+// The /24 (IPv4) or /48 (IPv6) of the client, to aggregate the
+// clients which are probably the same organization
+func clientPrefix(client net.Addr) string {
+	tcpAddr, error := net.ResolveTCPAddr(client.String())
+	if error != nil {
+		return "unknown"
+	}
+	ipv4 := tcpAddr.IP.To4()
+	if ipv4 != nil {
+		return ipv4.Mask(net.IPv4Mask(255, 255, 255, 0)).String() + "/24"
+	}
+	mask := make(net.IPMask, net.IPv6len)
+	for i := 0; i < 6; i++ {
+		mask[i] = 0xff
+	}
+	return tcpAddr.IP.Mask(mask).String() + "/48"
+}
+
+func (stats *statistics) record(query types.DNSquery, qname string, apex string, found bool) {
+	stats.mutex.Lock()
+	stats.queries++
+	if found {
+		stats.zones[apex]++
+		stats.qtypes[types.TypeName(query.Qtype)]++
+	} else {
+		stats.refused++
+	}
+	stats.mutex.Unlock()
+	if found {
+		stats.talkers.Add(clientPrefix(query.Client))
+		stats.names.Add(qname)
+	}
+}
+
+func copyCounters(counters map[string]uint64) map[string]uint64 {
+	result := make(map[string]uint64, len(counters))
+	for key, value := range counters {
+		result[key] = value
+	}
+	return result
+}
+
+func (stats *statistics) report() (result statisticsReport) {
+	stats.mutex.Lock()
+	result.Node = hostnamesoa.Mname
+	result.Start = stats.start
+	result.End = time.Seconds()
+	result.Queries = stats.queries
+	result.Refused = stats.refused
+	result.Zones = copyCounters(stats.zones)
+	result.Qtypes = copyCounters(stats.qtypes)
+	stats.mutex.Unlock()
+	result.TopTalkers = stats.talkers.Top(topN)
+	result.TopNames = stats.names.Top(topN)
+	return
+}
+
+// Writes the statistics every interval seconds. The file is replaced
+// atomically so readers never see a partial one.
+func dumpStatistics(filename string, interval int64) {
+	for {
+		time.Sleep(interval * 1e9)
+		data, error := json.Marshal(stats.report())
+		if error != nil {
+			fmt.Fprintf(os.Stderr, "Cannot encode the statistics: %s\n", error)
+			continue
+		}
+		temp := filename + ".tmp"
+		error = ioutil.WriteFile(temp, data, 0644)
+		if error == nil {
+			error = os.Rename(temp, filename)
+		}
+		if error != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write the statistics: %s\n", error)
+		}
+	}
+}
+
 func Respond(query types.DNSquery, config map[string]interface{}) (result types.DNSresponse) {
 	result.Ansection = nil
 	qname := strings.ToLower(query.Qname)
-	if query.Qclass == types.IN {
-		switch {
-		case as112Domain.Match([]byte(qname)):
-			result.Responsecode = types.NOERROR
-			switch {
-			case query.Qtype == types.NS:
-				result.Ansection = nsRecords(query.Qname)
-			case query.Qtype == types.SOA:
-				result.Ansection = make([]types.RR, 1)
-				result.Ansection[0] = soaRecord(query.Qname, as112soa)
-			default:
-				// Do nothing
-			}
-		case as112SubDomain.Match([]byte(qname)):
-			result.Responsecode = types.NXDOMAIN
-			// TODO: send the proper SOA in the authority section (so we
-			// must find which domain matched)
-		case qname == "hostname.as112.net":
-			result.Responsecode = types.NOERROR
-			switch query.Qtype { // TODO: handle ANY qtypes
-			case types.TXT:
-				result.Ansection = make([]types.RR, len(hostnameAnswers))
-				for i, text := range hostnameAnswers {
-					result.Ansection[i] = types.RR{
-						Name:  query.Qname,
-						TTL:   defaultTTL,
-						Type:  types.TXT,
-						Class: types.IN,
-						Data:  types.ToTXT(text),
-					}
-				}
-			case types.NS:
-				result.Ansection = nsRecords(query.Qname)
-			case types.SOA:
-				result.Ansection = []types.RR{soaRecord(query.Qname, hostnamesoa)}
-			default:
-				// Do nothing
-			}
-		default:
-			result.Responsecode = types.SERVFAIL
+	apex, zone, found := findZone(qname)
+	if stats != nil {
+		stats.record(query, qname, apex, found)
+	}
+	zoneMetric.Inc(apex)
+	// With statistics, every query must reach us
+	result.Cacheable = stats == nil
+	if query.Qclass != types.IN || !found {
+		// Not for us, RFC 7534, section 3.3
+		result.Responsecode = types.REFUSED
+		return result
+	}
+	result.Authoritative = true
+	if qname != apex {
+		// Nothing exists under the apex of the AS112 zones
+		result.Responsecode = types.NXDOMAIN
+		result.Nssection = []types.RR{negativeSoa(apex, *zone.soa)}
+		return result
+	}
+	result.Responsecode = types.NOERROR
+	switch {
+	case query.Qtype == types.NS:
+		result.Ansection = nsRecords(query.Qname, zone.nameServers)
+	case query.Qtype == types.SOA:
+		result.Ansection = []types.RR{soaRecord(query.Qname, *zone.soa)}
+	case query.Qtype == types.TXT && zone.hostname:
+		result.Ansection = txtRecords(query.Qname)
+	case query.Qtype == types.ALL:
+		result.Ansection = concat([]types.RR{soaRecord(query.Qname, *zone.soa)},
+			nsRecords(query.Qname, zone.nameServers))
+		if zone.hostname {
+			result.Ansection = concat(result.Ansection, txtRecords(query.Qname))
 		}
-	} else {
-		result.Responsecode = types.SERVFAIL
+	default:
+		result.Nssection = []types.RR{negativeSoa(apex, *zone.soa)}
 	}
 	return result
 }
 
+// Reads the list of zones to sink, one per line. Lines starting with
+// a # are comments.
+func readZones(filename string) (zones []string, error os.Error) {
+	content, error := ioutil.ReadFile(filename)
+	if error != nil {
+		return nil, error
+	}
+	lines := strings.Split(string(content), "\n", -1)
+	zones = make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if len(line) > 1 && line[len(line)-1] == '.' {
+			line = line[0 : len(line)-1]
+		}
+		zones = zones[0 : len(zones)+1]
+		zones[len(zones)-1] = line
+	}
+	return zones, nil
+}
+
+var zonesFile string
+
+func loadZones() os.Error {
+	zones := defaultZones
+	if zonesFile != "" {
+		var error os.Error
+		zones, error = readZones(zonesFile)
+		if error != nil {
+			return error
+		}
+	}
+	newZones := make(map[string]bool)
+	for _, zone := range zones {
+		newZones[zone] = true
+	}
+	sinkMutex.Lock()
+	sinkZones = newZones
+	sinkMutex.Unlock()
+	return nil
+}
+
+// Reads again the list of zones. If it fails, we keep the old one.
+func Reload() {
+	error := loadZones()
+	if error != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read the list of zones, keeping the old one: %s\n", error)
+	}
+}
+
 func Init(firstoption int) {
 	flag.Reinit(firstoption)
 	helpptr := flag.Bool("help", false, "Displays usage instructions")
@@ -144,6 +430,15 @@ func Init(firstoption int) {
 		"Set the location of this server, for instance \"ALIX exchange point in Somewhere, Somestate\"")
 	hostnameptr := flag.String("hostname", "",
 		"Set the official host name for this server")
+	zonesptr := flag.String("zones", "",
+		"Set the file which lists the zones to sink, one per line (default: RFC 1918 and 169.254)")
+	statsfileptr := flag.String("statsfile", "",
+		"Set the file where to write the statistics, in JSON (default: no statistics)")
+	intervalptr := flag.Int("statsinterval", 300,
+		"Set the interval between two writings of the statistics, in seconds")
+	topptr := flag.Int("top", 20, "Set the number of top clients and names in the statistics")
+	capacityptr := flag.Int("statscapacity", 1000,
+		"Set the number of clients and names tracked (more is more accurate but uses more memory)")
 	flag.Parse()
 	help := *helpptr
 	if help {
@@ -160,4 +455,28 @@ func Init(firstoption int) {
 	if *hostnameptr != "" {
 		hostnamesoa.Mname = *hostnameptr
 	}
+	for _, name := range []*string{&hostnamesoa.Mname, &hostnamesoa.Rname} {
+		if len(*name) > 1 && (*name)[len(*name)-1] == '.' {
+			*name = (*name)[0 : len(*name)-1]
+		}
+		if !types.ValidName(*name) {
+			fmt.Fprintf(os.Stderr, "Invalid domain name %s for -hostname or -email\n", *name)
+			os.Exit(1)
+		}
+	}
+	zonesFile = *zonesptr
+	error := loadZones()
+	if error != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read the list of zones: %s\n", error)
+		os.Exit(1)
+	}
+	if *statsfileptr != "" {
+		if *intervalptr <= 0 || *topptr <= 0 || *capacityptr < *topptr {
+			fmt.Fprintf(os.Stderr, "Invalid statistics options\n")
+			os.Exit(1)
+		}
+		topN = *topptr
+		stats = newStatistics(*capacityptr)
+		go dumpStatistics(*statsfileptr, int64(*intervalptr))
+	}
 }
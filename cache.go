@@ -0,0 +1,100 @@
+/* A cache of responses, already serialized, for the responders whose
+   answers depend only on the question (and not, for instance, on the
+   address of the client). When a query hits the cache, the front-end
+   sends the stored message after patching the ID and the case of the
+   query name, without calling the responder. The EDNS payload size of
+   the OPT record is always the same, so it needs no patching.
+
+   The size is bounded, the least recently used entries are evicted
+   first, and the entries expire after a maximum age.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+	"./types"
+)
+
+type Entry struct {
+	Response types.DNSresponse // What the responder returned
+	Wire     []byte            // The serialized response
+	key      string
+	expires  int64
+}
+
+type Cache struct {
+	capacity int
+	maxAge   int64 // Seconds
+	entries  map[string]*list.Element
+	lru      *list.List // Of *Entry, the most recently used first
+	mutex    sync.Mutex
+	Hits     uint64
+	Misses   uint64
+}
+
+func New(capacity int, maxAge int64) *Cache {
+	return &Cache{capacity: capacity, maxAge: maxAge,
+		entries: make(map[string]*list.Element, capacity), lru: list.New()}
+}
+
+// Returns the entry for this key, if it exists and has not expired
+func (cache *Cache) Get(key string) (*Entry, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, exists := cache.entries[key]
+	if !exists {
+		cache.Misses++
+		return nil, false
+	}
+	entry := element.Value.(*Entry)
+	if entry.expires < time.Seconds() {
+		cache.remove(element)
+		cache.Misses++
+		return nil, false
+	}
+	cache.lru.MoveToFront(element)
+	cache.Hits++
+	return entry, true
+}
+
+func (cache *Cache) remove(element *list.Element) {
+	cache.entries[element.Value.(*Entry).key] = nil, false
+	cache.lru.Remove(element)
+}
+
+// Stores a response. The cache keeps wire, the caller must not modify
+// it afterwards.
+func (cache *Cache) Add(key string, response types.DNSresponse, wire []byte) {
+	entry := &Entry{Response: response, Wire: wire, key: key,
+		expires: time.Seconds() + cache.maxAge}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, exists := cache.entries[key]
+	if exists {
+		cache.remove(element)
+	}
+	for cache.lru.Len() >= cache.capacity {
+		cache.remove(cache.lru.Back())
+	}
+	cache.entries[key] = cache.lru.PushFront(entry)
+}
+
+func (cache *Cache) Statistics() (hits uint64, misses uint64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.Hits, cache.Misses
+}
+
+// Forgets everything, for instance when the data of the responder are
+// reloaded
+func (cache *Cache) Flush() {
+	cache.mutex.Lock()
+	cache.entries = make(map[string]*list.Element, cache.capacity)
+	cache.lru.Init()
+	cache.mutex.Unlock()
+}
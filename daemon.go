@@ -0,0 +1,227 @@
+/* What a Unix daemon needs: detaching from the terminal, PID file,
+   dropping privileges (and chroot) after binding to port 53, and
+   the integration with systemd (socket activation, where systemd
+   binds the sockets and passes them, and readiness notification).
+
+   Go cannot fork() safely (the runtime already has several threads)
+   so we detach by starting the program again, in a new session, with
+   an environment variable telling the new process it is the daemon.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package daemon
+
+import (
+	"exec"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const childVariable = "GRONG_DAEMON"
+
+// Tells if we run under systemd, which does not want us to detach
+func UnderSystemd() bool {
+	return os.Getenv("NOTIFY_SOCKET") != "" || os.Getenv("LISTEN_FDS") != ""
+}
+
+// Detaches from the terminal. In the original process, it starts the
+// daemon and exits. In the daemon, it returns. The daemon keeps the
+// current directory, so the relative file names of the options are
+// still valid, for instance when reloading.
+func Detach() os.Error {
+	if os.Getenv(childVariable) != "" {
+		_, errno := syscall.Setsid()
+		if errno != 0 {
+			return os.NewSyscallError("setsid", errno)
+		}
+		return nil
+	}
+	program, error := exec.LookPath(os.Args[0])
+	if error != nil {
+		return error
+	}
+	directory, error := os.Getwd()
+	if error != nil {
+		return error
+	}
+	if !strings.HasPrefix(program, "/") { // "./grong" for instance
+		program = path.Join(directory, program)
+	}
+	null, error := os.Open("/dev/null", os.O_RDWR, 0)
+	if error != nil {
+		return error
+	}
+	environment := os.Environ()
+	newenvironment := make([]string, len(environment)+1)
+	copy(newenvironment, environment)
+	newenvironment[len(environment)] = childVariable + "=1"
+	_, error = os.ForkExec(program, os.Args, newenvironment, directory,
+		[]*os.File{null, null, null})
+	if error != nil {
+		return error
+	}
+	os.Exit(0)
+	return nil // Never reached
+}
+
+func WritePidFile(filename string) os.Error {
+	return ioutil.WriteFile(filename, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// Finds a name in /etc/passwd or /etc/group and returns the third
+// and fourth fields (UID and GID for passwd, GID for group)
+func lookup(filename string, name string) (id int, gid int, error os.Error) {
+	content, error := ioutil.ReadFile(filename)
+	if error != nil {
+		return 0, 0, error
+	}
+	for _, line := range strings.Split(string(content), "\n", -1) {
+		fields := strings.Split(line, ":", -1)
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		id, error = strconv.Atoi(fields[2])
+		if error == nil && len(fields) >= 4 && filename == "/etc/passwd" {
+			gid, error = strconv.Atoi(fields[3])
+		}
+		return id, gid, error
+	}
+	return 0, 0, os.NewError(fmt.Sprintf("%s not found in %s", name, filename))
+}
+
+// Tells if DropPrivileges can change the user. On Linux, setuid() and
+// setgid() change only the calling thread, and the Go runtime has
+// others, which would keep running as root. There, socket activation
+// (systemd binds port 53 and starts GRONG unprivileged) must be used.
+func SetuidSupported() bool {
+	return runtime.GOOS != "linux"
+}
+
+// Changes the root directory (if chroot is not empty) and the user and
+// group (if username is not empty; the group is the one of the user if
+// groupname is empty). The names are resolved before the chroot.
+func DropPrivileges(username string, groupname string, chroot string) os.Error {
+	var uid, gid int
+	var error os.Error
+	if username != "" && !SetuidSupported() {
+		return os.NewError("changing the user is not possible on " + runtime.GOOS +
+			" (setuid() changes only one thread), use socket activation")
+	}
+	if username != "" {
+		uid, gid, error = lookup("/etc/passwd", username)
+		if error != nil {
+			return error
+		}
+	}
+	if groupname != "" {
+		gid, _, error = lookup("/etc/group", groupname)
+		if error != nil {
+			return error
+		}
+	}
+	if chroot != "" {
+		errno := syscall.Chroot(chroot)
+		if errno != 0 {
+			return os.NewSyscallError("chroot", errno)
+		}
+		error = os.Chdir("/")
+		if error != nil {
+			return error
+		}
+	}
+	if username == "" {
+		return nil
+	}
+	errno := syscall.Setgroups([]int{gid})
+	if errno != 0 {
+		return os.NewSyscallError("setgroups", errno)
+	}
+	errno = syscall.Setgid(gid)
+	if errno != 0 {
+		return os.NewSyscallError("setgid", errno)
+	}
+	errno = syscall.Setuid(uid)
+	if errno != 0 {
+		return os.NewSyscallError("setuid", errno)
+	}
+	return nil
+}
+
+// The sockets passed by systemd (socket activation, see
+// sd_listen_fds(3)): they start at file descriptor 3. Returns nothing
+// if we are not socket-activated.
+func SystemdListeners() (udp []*net.UDPConn, tcp []*net.TCPListener, error os.Error) {
+	pid, error := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if error != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	n, error := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if error != nil {
+		return nil, nil, os.NewError("invalid LISTEN_FDS")
+	}
+	udp = make([]*net.UDPConn, 0, n)
+	tcp = make([]*net.TCPListener, 0, n)
+	for fd := 3; fd < 3+n; fd++ {
+		sotype, errno := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+		if errno != 0 {
+			return nil, nil, os.NewSyscallError("getsockopt", errno)
+		}
+		file := os.NewFile(fd, fmt.Sprintf("systemd socket %d", fd))
+		if sotype == syscall.SOCK_DGRAM {
+			conn, error := net.FilePacketConn(file)
+			if error != nil {
+				return nil, nil, error
+			}
+			udpconn, ok := conn.(*net.UDPConn)
+			if !ok { // A Unix datagram socket, for instance
+				return nil, nil, os.NewError(fmt.Sprintf("systemd socket %d is not a UDP one", fd))
+			}
+			udp = udp[0 : len(udp)+1]
+			udp[len(udp)-1] = udpconn
+		} else {
+			listener, error := net.FileListener(file)
+			if error != nil {
+				return nil, nil, error
+			}
+			tcplistener, ok := listener.(*net.TCPListener)
+			if !ok {
+				return nil, nil, os.NewError(fmt.Sprintf("systemd socket %d is not a TCP one", fd))
+			}
+			tcp = tcp[0 : len(tcp)+1]
+			tcp[len(tcp)-1] = tcplistener
+		}
+		file.Close() // The net package has its own copy
+	}
+	// Not for our children
+	os.Setenv("LISTEN_PID", "")
+	os.Setenv("LISTEN_FDS", "")
+	return udp, tcp, nil
+}
+
+// Tells systemd about our state, for instance "READY=1", see
+// sd_notify(3). Does nothing if we are not started by systemd with
+// Type=notify.
+func Notify(state string) os.Error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' { // Abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, error := net.Dial("unixgram", "", socket)
+	if error != nil {
+		return error
+	}
+	defer conn.Close()
+	_, error = conn.Write([]byte(state))
+	return error
+}
@@ -0,0 +1,462 @@
+/* DNSSEC (RFC 4033 to 4035): keys, signatures (RRSIG) and denial of
+   existence (NSEC), for the responders which sign on the fly.
+
+   Only the algorithms 13 (ECDSA P-256 with SHA-256, RFC 6605) and 15
+   (Ed25519, RFC 8080) are supported. ECDSA is done by the standard
+   library, Ed25519 by Adam Langley's package (goinstall
+   github.com/agl/ed25519), a port of the reference implementation
+   of the paper. Signing is still not free, hence the cache of
+   signatures.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package dnssec
+
+import (
+	"big"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/agl/ed25519"
+	"./types"
+)
+
+const (
+	// Algorithms, RFC 8624
+	ECDSAP256SHA256 = 13
+	ED25519         = 15
+
+	// Flags of DNSKEY, RFC 4034, section 2.1.1
+	ZSKflags = 256
+	KSKflags = 257 // With the SEP bit
+
+	inceptionOffset = 3600 // Seconds in the past, for the clocks which are late
+)
+
+// Big-endian, left-padded with zeroes
+func padded(x *big.Int, size int) []byte {
+	bigendian := x.Bytes()
+	result := make([]byte, size)
+	copy(result[size-len(bigendian):], bigendian)
+	return result
+}
+
+type Key struct {
+	Flags      uint16
+	Algorithm  uint8
+	PublicKey  []byte // As in the DNSKEY record
+	Tag        uint16
+	ecdsaKey   *ecdsa.PrivateKey
+	ed25519Key *[64]byte // The seed then the public key, as package ed25519 wants it
+}
+
+// Reads a private key in the format of BIND's dnssec-keygen (the
+// ".private" file). flags is ZSKflags or KSKflags.
+func ReadKey(filename string, flags uint16) (key *Key, error os.Error) {
+	content, error := ioutil.ReadFile(filename)
+	if error != nil {
+		return nil, error
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n", -1) {
+		colon := strings.Index(line, ":")
+		if colon != -1 {
+			fields[strings.TrimSpace(line[0:colon])] = strings.TrimSpace(line[colon+1:])
+		}
+	}
+	words := strings.Fields(fields["Algorithm"]) // "13 (ECDSAP256SHA256)"
+	if len(words) == 0 {
+		return nil, os.NewError(fmt.Sprintf("%s: no algorithm", filename))
+	}
+	algorithm, error := strconv.Atoui(words[0])
+	if error != nil {
+		return nil, os.NewError(fmt.Sprintf("%s: no valid algorithm", filename))
+	}
+	encoded := fields["PrivateKey"]
+	private := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, error := base64.StdEncoding.Decode(private, []byte(encoded))
+	if error != nil || n != 32 {
+		return nil, os.NewError(fmt.Sprintf("%s: no valid private key", filename))
+	}
+	private = private[0:n]
+	key = &Key{Flags: flags, Algorithm: uint8(algorithm)}
+	switch algorithm {
+	case ECDSAP256SHA256:
+		curve := elliptic.P256()
+		d := new(big.Int).SetBytes(private)
+		if d.Sign() == 0 || d.Cmp(curve.N) >= 0 {
+			return nil, os.NewError(fmt.Sprintf("%s: private key out of range", filename))
+		}
+		key.ecdsaKey = &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve}, D: d}
+		key.ecdsaKey.X, key.ecdsaKey.Y = curve.ScalarBaseMult(private)
+		key.PublicKey = bytes.Add(padded(key.ecdsaKey.X, 32), padded(key.ecdsaKey.Y, 32))
+	case ED25519:
+		// The private key is actually a seed (RFC 8032, section
+		// 5.1.5) and GenerateKey turns the 32 bytes it reads into
+		// the key pair
+		public, pair, error := ed25519.GenerateKey(bytes.NewBuffer(private))
+		if error != nil {
+			return nil, os.NewError(fmt.Sprintf("%s: %s", filename, error))
+		}
+		key.ed25519Key = pair
+		key.PublicKey = public[0:]
+	default:
+		return nil, os.NewError(fmt.Sprintf("%s: unsupported algorithm %d", filename, algorithm))
+	}
+	key.Tag = keyTag(key.Rdata())
+	return key, nil
+}
+
+// The RDATA of the DNSKEY record, RFC 4034, section 2.1
+func (key *Key) Rdata() []byte {
+	result := make([]byte, 4)
+	binary.BigEndian.PutUint16(result[0:2], key.Flags)
+	result[2] = 3 // Protocol
+	result[3] = key.Algorithm
+	return bytes.Add(result, key.PublicKey)
+}
+
+// RFC 4034, appendix B
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 1 {
+			ac += uint32(b)
+		} else {
+			ac += uint32(b) << 8
+		}
+	}
+	ac += (ac >> 16) & 0xFFFF
+	return uint16(ac & 0xFFFF)
+}
+
+func (key *Key) sign(data []byte) []byte {
+	switch key.Algorithm {
+	case ECDSAP256SHA256:
+		// RFC 6605, section 4: r and s, 32 bytes each
+		h := sha256.New()
+		h.Write(data)
+		r, s, error := ecdsa.Sign(rand.Reader, key.ecdsaKey, h.Sum())
+		if error != nil {
+			panic(fmt.Sprintf("Cannot sign: %s", error))
+		}
+		return bytes.Add(padded(r, 32), padded(s, 32))
+	case ED25519:
+		// RFC 8080, section 4
+		return ed25519.Sign(key.ed25519Key, data)[0:]
+	}
+	panic(fmt.Sprintf("Unsupported algorithm %d", key.Algorithm))
+}
+
+type canonicalRdata []types.RR
+
+func (rrset canonicalRdata) Len() int { return len(rrset) }
+
+func (rrset canonicalRdata) Less(i, j int) bool {
+	return bytes.Compare(rrset[i].Data, rrset[j].Data) < 0
+}
+
+func (rrset canonicalRdata) Swap(i, j int) { rrset[i], rrset[j] = rrset[j], rrset[i] }
+
+type typeList []uint16
+
+func (list typeList) Len() int { return len(list) }
+
+func (list typeList) Less(i, j int) bool { return list[i] < list[j] }
+
+func (list typeList) Swap(i, j int) { list[i], list[j] = list[j], list[i] }
+
+// Number of labels, not counting the root and a leading wildcard, RFC
+// 4034, section 3.1.3
+func labels(name string) byte {
+	if name == "." {
+		return 0
+	}
+	result := strings.Count(name, ".") + 1
+	if strings.HasPrefix(name, "*.") || name == "*" {
+		result--
+	}
+	return byte(result)
+}
+
+func putShort(buf *bytes.Buffer, i uint16) {
+	temp := make([]byte, 2)
+	binary.BigEndian.PutUint16(temp, i)
+	buf.Write(temp)
+}
+
+func putLong(buf *bytes.Buffer, i uint32) {
+	temp := make([]byte, 4)
+	binary.BigEndian.PutUint32(temp, i)
+	buf.Write(temp)
+}
+
+// The RDATA of the RRSIG record of a RRset (all the records must have
+// the same name, type and TTL), without the signature, and the data
+// to sign, which begins with it. RFC 4034, section 3.1.8.1
+func signedData(zone string, rrset []types.RR, key *Key, inception, expiration uint32) (rdata []byte, data []byte) {
+	owner := rrset[0].Name
+	buf := new(bytes.Buffer)
+	putShort(buf, rrset[0].Type)
+	buf.WriteByte(key.Algorithm)
+	buf.WriteByte(labels(owner))
+	putLong(buf, rrset[0].TTL)
+	putLong(buf, expiration)
+	putLong(buf, inception)
+	putShort(buf, key.Tag)
+	buf.Write(types.Encode(zone))
+	rdata = bytes.Add(nil, buf.Bytes())
+	sorted := make([]types.RR, len(rrset))
+	copy(sorted, rrset)
+	sort.Sort(canonicalRdata(sorted))
+	for _, rr := range sorted {
+		buf.Write(types.Encode(strings.ToLower(owner)))
+		putShort(buf, rr.Type)
+		putShort(buf, rr.Class)
+		putLong(buf, rrset[0].TTL)
+		putShort(buf, uint16(len(rr.Data)))
+		buf.Write(rr.Data)
+	}
+	return rdata, buf.Bytes()
+}
+
+// Signs a RRset and returns the RRSIG record
+func rrsig(zone string, rrset []types.RR, key *Key, inception, expiration uint32) types.RR {
+	rdata, data := signedData(zone, rrset, key, inception, expiration)
+	return types.RR{Name: rrset[0].Name, Type: types.RRSIG, Class: rrset[0].Class,
+		TTL: rrset[0].TTL, Data: bytes.Add(rdata, key.sign(data))}
+}
+
+// The type bit maps field of NSEC and NSEC3, RFC 4034, section 4.1.2
+func TypeBitmap(rrtypes []uint16) []byte {
+	sorted := make([]uint16, len(rrtypes))
+	copy(sorted, rrtypes)
+	sort.Sort(typeList(sorted))
+	result := new(bytes.Buffer)
+	for i := 0; i < len(sorted); {
+		window := sorted[i] >> 8
+		bitmap := make([]byte, 32)
+		length := 0
+		for ; i < len(sorted) && sorted[i]>>8 == window; i++ {
+			low := sorted[i] & 0xFF
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			length = int(low/8) + 1
+		}
+		result.WriteByte(byte(window))
+		result.WriteByte(byte(length))
+		result.Write(bitmap[0:length])
+	}
+	return result.Bytes()
+}
+
+// The successor of a name which is too long to get one more label: the
+// last byte of its first label is incremented (RFC 4471, section
+// 3.1.2). There is no valid name between them since they would be
+// longer. If the byte cannot be incremented, we give up and return
+// the name itself.
+func successor(name string) string {
+	end := strings.Index(name, ".")
+	if end == -1 {
+		end = len(name)
+	}
+	if name[end-1] == 0xFF {
+		return name
+	}
+	result := []byte(name)
+	result[end-1]++
+	return string(result)
+}
+
+// The NSEC record of compact denial of existence (RFC 9824): it covers
+// only the name, the next name being its immediate successor in the
+// canonical order. present are the types which exist at this name.
+func CompactNSEC(name string, present []uint16, ttl uint32) types.RR {
+	next := "\000." + name
+	if name == "." {
+		next = "\000"
+	} else if !types.ValidName(next) {
+		next = successor(name)
+	}
+	rrtypes := make([]uint16, len(present)+2)
+	copy(rrtypes, present)
+	rrtypes[len(present)] = types.RRSIG
+	rrtypes[len(present)+1] = types.NSEC
+	return types.RR{Name: name, Type: types.NSEC, Class: types.IN, TTL: ttl,
+		Data: bytes.Add(types.Encode(next), TypeBitmap(rrtypes))}
+}
+
+func reversedLabels(name string) []string {
+	if name == "." {
+		return []string{}
+	}
+	labels := strings.Split(name, ".", -1)
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// Compares two (lowercase) names in the canonical order of RFC 4034,
+// section 6.1: label by label, starting from the root. Returns -1, 0
+// or 1.
+func CanonicalCompare(a, b string) int {
+	alabels := reversedLabels(a)
+	blabels := reversedLabels(b)
+	for i := 0; i < len(alabels) && i < len(blabels); i++ {
+		result := bytes.Compare([]byte(alabels[i]), []byte(blabels[i]))
+		if result != 0 {
+			return result
+		}
+	}
+	switch {
+	case len(alabels) < len(blabels):
+		return -1
+	case len(alabels) > len(blabels):
+		return 1
+	}
+	return 0
+}
+
+// The hashed owner name of NSEC3, RFC 5155, section 5. Only SHA-1
+// is defined.
+func NSEC3Hash(name string, salt []byte, iterations uint16) []byte {
+	h := sha1.New()
+	h.Write(types.Encode(strings.ToLower(name)))
+	h.Write(salt)
+	digest := h.Sum()
+	for i := uint16(0); i < iterations; i++ {
+		h = sha1.New()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum()
+	}
+	return digest
+}
+
+const base32hex = "0123456789abcdefghijklmnopqrstuv" // RFC 4648, section 7
+
+// Base 32 with the extended hex alphabet, in lowercase and without
+// padding, as used in the names of NSEC3 records
+func EncodeBase32hex(data []byte) string {
+	result := make([]byte, 0, (len(data)*8+4)/5)
+	var buffer uint
+	bits := uint(0)
+	for _, b := range data {
+		buffer = buffer<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			result = result[0 : len(result)+1]
+			result[len(result)-1] = base32hex[(buffer>>bits)&0x1F]
+		}
+	}
+	if bits > 0 {
+		result = result[0 : len(result)+1]
+		result[len(result)-1] = base32hex[(buffer<<(5-bits))&0x1F]
+	}
+	return string(result)
+}
+
+func DecodeBase32hex(s string) ([]byte, bool) {
+	s = strings.ToLower(s)
+	result := make([]byte, 0, len(s)*5/8)
+	var buffer uint
+	bits := uint(0)
+	for i := 0; i < len(s); i++ {
+		value := strings.Index(base32hex, s[i:i+1])
+		if value == -1 {
+			return nil, false
+		}
+		buffer = buffer<<5 | uint(value)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			result = result[0 : len(result)+1]
+			result[len(result)-1] = byte(buffer >> bits)
+		}
+	}
+	return result, true
+}
+
+type cachedSignature struct {
+	rrsig      types.RR
+	expiration int64
+}
+
+// A Signer signs the RRsets of a zone. The signatures of the static
+// data are kept until half of their validity period.
+type Signer struct {
+	Zone     string
+	KSK, ZSK *Key  // The same key if there is only one (CSK)
+	Validity int64 // In seconds
+	cache    map[string]cachedSignature
+	mutex    sync.Mutex
+}
+
+func NewSigner(zone string, ksk *Key, zsk *Key, validity int64) *Signer {
+	return &Signer{Zone: zone, KSK: ksk, ZSK: zsk, Validity: validity,
+		cache: make(map[string]cachedSignature)}
+}
+
+// The DNSKEY RRset of the zone
+func (signer *Signer) DNSKEYs(ttl uint32) []types.RR {
+	if signer.KSK == signer.ZSK {
+		return []types.RR{types.RR{Name: signer.Zone, Type: types.DNSKEY,
+			Class: types.IN, TTL: ttl, Data: signer.KSK.Rdata()}}
+	}
+	return []types.RR{
+		types.RR{Name: signer.Zone, Type: types.DNSKEY, Class: types.IN,
+			TTL: ttl, Data: signer.KSK.Rdata()},
+		types.RR{Name: signer.Zone, Type: types.DNSKEY, Class: types.IN,
+			TTL: ttl, Data: signer.ZSK.Rdata()},
+	}
+}
+
+// Returns the RRSIG of the RRset. If cache is true, the RRset must be
+// part of the zone data (so the same name and type always give the
+// same RRset): the signature is then kept for the next queries.
+func (signer *Signer) Sign(rrset []types.RR, cache bool) types.RR {
+	now := time.Seconds()
+	cachekey := fmt.Sprintf("%s/%d", rrset[0].Name, rrset[0].Type)
+	if cache {
+		signer.mutex.Lock()
+		cached, found := signer.cache[cachekey]
+		signer.mutex.Unlock()
+		if found && now < cached.expiration-signer.Validity/2 {
+			return cached.rrsig
+		}
+	}
+	key := signer.ZSK
+	if rrset[0].Type == types.DNSKEY {
+		key = signer.KSK
+	}
+	expiration := now + signer.Validity
+	result := rrsig(signer.Zone, rrset, key, uint32(now-inceptionOffset), uint32(expiration))
+	if cache {
+		signer.mutex.Lock()
+		signer.cache[cachekey] = cachedSignature{rrsig: result, expiration: expiration}
+		signer.mutex.Unlock()
+	}
+	return result
+}
+
+// Forgets the signatures, for instance after a reload of the zone
+func (signer *Signer) Flush() {
+	signer.mutex.Lock()
+	signer.cache = make(map[string]cachedSignature)
+	signer.mutex.Unlock()
+}
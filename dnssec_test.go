@@ -0,0 +1,196 @@
+/* Tests of the DNSSEC signatures with the examples of RFC 6605
+   (ECDSA) and RFC 8080 (Ed25519).
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package dnssec
+
+import (
+	"big"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"./types"
+)
+
+func decode64(t *testing.T, s string) []byte {
+	result := make([]byte, base64.StdEncoding.DecodedLen(len(s)))
+	n, error := base64.StdEncoding.Decode(result, []byte(s))
+	if error != nil {
+		t.Fatalf("Invalid Base64 %s: %s", s, error)
+	}
+	return result[0:n]
+}
+
+// Writes a private key file and reads it with ReadKey
+func readTestKey(t *testing.T, content string, flags uint16) (*Key, os.Error) {
+	file, error := ioutil.TempFile("", "grong-key")
+	if error != nil {
+		t.Fatalf("Cannot create a temporary file: %s", error)
+	}
+	defer os.Remove(file.Name())
+	file.Write([]byte(content))
+	file.Close()
+	return ReadKey(file.Name(), flags)
+}
+
+// RFC 6605, section 6.1. ECDSA signatures are not deterministic so we
+// check that the published signature verifies against the data we
+// sign, and that our own signatures verify.
+func TestRFC6605(t *testing.T) {
+	public := decode64(t, "GojIhhXUN/u4v54ZQqGSnyhWJwaubCvTmeexv7bR6edb"+
+		"krSqQpF64cYbcB7wNcP+e+MAnLr+Wi9xMWyQLc8NAA==")
+	key := &Key{Flags: KSKflags, Algorithm: ECDSAP256SHA256, PublicKey: public}
+	key.Tag = keyTag(key.Rdata())
+	if key.Tag != 55648 {
+		t.Errorf("Key tag is %d, expected 55648", key.Tag)
+	}
+	rrset := []types.RR{types.RR{Name: "www.example.net", Type: types.A, Class: types.IN,
+		TTL: 3600, Data: []byte{192, 0, 2, 1}}}
+	// 20100812100439 and 20100909100439
+	_, data := signedData("example.net", rrset, key, 1281607479, 1284026679)
+	signature := decode64(t, "qx6wLYqmh+l9oCKTN6qIc+bw6ya+KJ8oMz0YP107epXA"+
+		"yGmt+3SNruPFKG7tZoLBLlUzGGus7ZwmwWep666VCw==")
+	verifier := &ecdsa.PublicKey{Curve: elliptic.P256(),
+		X: new(big.Int).SetBytes(public[0:32]), Y: new(big.Int).SetBytes(public[32:64])}
+	h := sha256.New()
+	h.Write(data)
+	if !ecdsa.Verify(verifier, h.Sum(), new(big.Int).SetBytes(signature[0:32]),
+		new(big.Int).SetBytes(signature[32:64])) {
+		t.Errorf("The signature of RFC 6605 does not verify")
+	}
+
+	private, error := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if error != nil {
+		t.Fatalf("Cannot generate a key: %s", error)
+	}
+	key, error = readTestKey(t, "Private-key-format: v1.2\n"+
+		"Algorithm: 13 (ECDSAP256SHA256)\n"+
+		"PrivateKey: "+base64.StdEncoding.EncodeToString(padded(private.D, 32))+"\n",
+		ZSKflags)
+	if error != nil {
+		t.Fatalf("Cannot read the key: %s", error)
+	}
+	if !bytes.Equal(key.PublicKey, bytes.Add(padded(private.X, 32), padded(private.Y, 32))) {
+		t.Errorf("Wrong public key %x", key.PublicKey)
+	}
+	rdata, data := signedData("example.net", rrset, key, 1281607479, 1284026679)
+	sig := rrsig("example.net", rrset, key, 1281607479, 1284026679)
+	if !bytes.HasPrefix(sig.Data, rdata) || len(sig.Data) != len(rdata)+64 {
+		t.Fatalf("Wrong RRSIG %x", sig.Data)
+	}
+	signature = sig.Data[len(rdata):]
+	h = sha256.New()
+	h.Write(data)
+	if !ecdsa.Verify(&private.PublicKey, h.Sum(), new(big.Int).SetBytes(signature[0:32]),
+		new(big.Int).SetBytes(signature[32:64])) {
+		t.Errorf("Our signature does not verify")
+	}
+}
+
+// RFC 8080, section 6.1. Ed25519 signatures are deterministic so we
+// must produce exactly the published one.
+func TestRFC8080(t *testing.T) {
+	key, error := readTestKey(t, "Private-key-format: v1.2\n"+
+		"Algorithm: 15 (ED25519)\n"+
+		"PrivateKey: ODIyNjAzODQ2MjgwODAxMjI2NDUxOTAyMDQxNDIyNjI=\n", KSKflags)
+	if error != nil {
+		t.Fatalf("Cannot read the key: %s", error)
+	}
+	public := base64.StdEncoding.EncodeToString(key.PublicKey)
+	if public != "l02Woi0iS8Aa25FQkUd9RMzZHJpBoRQwAQEX1SxZJA4=" {
+		t.Errorf("Public key is %s", public)
+	}
+	if key.Tag != 3613 {
+		t.Errorf("Key tag is %d, expected 3613", key.Tag)
+	}
+	mx := bytes.Add([]byte{0, 10}, types.Encode("mail.example.com"))
+	rrset := []types.RR{types.RR{Name: "example.com", Type: types.MX, Class: types.IN,
+		TTL: 3600, Data: mx}}
+	sig := rrsig("example.com", rrset, key, 1438207200, 1440021600)
+	rdata, _ := signedData("example.com", rrset, key, 1438207200, 1440021600)
+	signature := base64.StdEncoding.EncodeToString(sig.Data[len(rdata):])
+	if signature != "oL9krJun7xfBOIWcGHi7mag5/hdZrKWw15jPGrHpjQeRAvTdszaPD+QLs3f"+
+		"x8A4M3e23mRZ9VrbpMngwcrqNAg==" {
+		t.Errorf("Signature is %s", signature)
+	}
+}
+
+func TestBadKeys(t *testing.T) {
+	_, error := readTestKey(t, "Private-key-format: v1.2\n"+
+		"Algorithm: 8 (RSASHA256)\n"+
+		"PrivateKey: ODIyNjAzODQ2MjgwODAxMjI2NDUxOTAyMDQxNDIyNjI=\n", ZSKflags)
+	if error == nil {
+		t.Errorf("RSA key accepted")
+	}
+	// The order of P-256, which is not a valid private key
+	_, error = readTestKey(t, "Private-key-format: v1.2\n"+
+		"Algorithm: 13 (ECDSAP256SHA256)\n"+
+		"PrivateKey: /////wAAAAD//////////7zm+q2nF56E87nKwvxjJVE=\n", ZSKflags)
+	if error == nil {
+		t.Errorf("Out of range ECDSA key accepted")
+	}
+}
+
+type nsec3Test struct {
+	name   string
+	hashed string
+}
+
+// RFC 5155, appendix A: salt aabbccdd, 12 iterations
+var nsec3Tests = []nsec3Test{
+	nsec3Test{"example", "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom"},
+	nsec3Test{"a.example", "35mthgpgcu1qg68fab165klnsnk3dpvl"},
+	nsec3Test{"*.w.example", "r53bq7cc2uvmubfu5ocmm6pers9tk9en"},
+	nsec3Test{"X.W.Example", "b4um86eghhds6nea196smvmlo4ors995"}, // Hashed in lowercase
+}
+
+func TestNSEC3Hash(t *testing.T) {
+	for _, test := range nsec3Tests {
+		hashed := EncodeBase32hex(NSEC3Hash(test.name, []byte{0xaa, 0xbb, 0xcc, 0xdd}, 12))
+		if hashed != test.hashed {
+			t.Errorf("%s hashed as %s instead of %s", test.name, hashed, test.hashed)
+		}
+	}
+}
+
+// The longest names of the wire, signed on the fly, must not make
+// the encoding fail: 3 labels of 63 bytes and one of 61, 253 bytes
+func TestLongNames(t *testing.T) {
+	label63 := strings.Repeat("a", 63)
+	name := label63 + "." + label63 + "." + label63 + "." + strings.Repeat("b", 61)
+	wire := types.Encode(name)
+	decoded, _, ok := types.Decode(wire)
+	if !ok || decoded != name {
+		t.Fatalf("Name of %d bytes not decoded", len(wire))
+	}
+	nsec := CompactNSEC(name, []uint16{types.A}, 3600)
+	next, _, ok := types.Decode(nsec.Data)
+	if !ok || CanonicalCompare(name, next) >= 0 {
+		t.Errorf("Wrong next name %s", next)
+	}
+	key, error := readTestKey(t, "Private-key-format: v1.2\n"+
+		"Algorithm: 15 (ED25519)\n"+
+		"PrivateKey: ODIyNjAzODQ2MjgwODAxMjI2NDUxOTAyMDQxNDIyNjI=\n", ZSKflags)
+	if error != nil {
+		t.Fatalf("Cannot read the key: %s", error)
+	}
+	rrset := []types.RR{types.RR{Name: name, Type: types.A, Class: types.IN,
+		TTL: 3600, Data: []byte{192, 0, 2, 1}}}
+	sig := rrsig(strings.Repeat("b", 61), rrset, key, 1438207200, 1440021600)
+	if sig.Name != name || len(sig.Data) == 0 {
+		t.Errorf("Wrong RRSIG %v", sig)
+	}
+	sig = rrsig(strings.Repeat("b", 61), []types.RR{nsec}, key, 1438207200, 1440021600)
+	if sig.Type != types.RRSIG {
+		t.Errorf("Wrong RRSIG of the NSEC %v", sig)
+	}
+}
@@ -0,0 +1,297 @@
+/* dnstap <https://dnstap.info/>: a log of the DNS messages, encoded
+   with Protocol Buffers and sent in Frame Streams, to a file or to a
+   Unix socket (for instance the one of dnstap-read or of
+   fstrm_capture).
+
+   The Protocol Buffers encoding is done by hand, for the few fields
+   of dnstap.proto we use. Messages are queued and written by a
+   separate goroutine. If the queue is full (the reader is too slow),
+   they are dropped and counted, the DNS service is never slowed
+   down.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package dnstap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+const (
+	contentType = "protobuf:dnstap.Dnstap"
+
+	// Frame Streams control frames
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+
+	fieldContentType = 0x01
+
+	// dnstap.proto
+	dnstapMessage       = 1 // Dnstap.Type
+	messageAuthQuery    = 1 // Message.Type
+	messageAuthResponse = 2
+	familyInet          = 1
+	familyInet6         = 2
+	protocolUDP         = 1
+	protocolTCP         = 2
+	protocolDOT         = 3
+	protocolDOH         = 4
+
+	queueSize = 10000
+)
+
+type Writer struct {
+	output   io.WriteCloser
+	queue    chan []byte
+	identity string
+	version  string
+	done     chan bool  // When run is over
+	mutex    sync.Mutex // Protects the two fields below
+	dropped  uint64
+	closed   bool
+}
+
+// Protocol Buffers encoding, only the wire types we need:
+// varint (0), 64-bit (1), length-delimited (2) and 32-bit (5)
+
+func putVarint(buf *bytes.Buffer, value uint64) {
+	for value >= 0x80 {
+		buf.WriteByte(byte(value) | 0x80)
+		value >>= 7
+	}
+	buf.WriteByte(byte(value))
+}
+
+func putKey(buf *bytes.Buffer, field int, wiretype int) {
+	putVarint(buf, uint64(field<<3|wiretype))
+}
+
+func putVarintField(buf *bytes.Buffer, field int, value uint64) {
+	putKey(buf, field, 0)
+	putVarint(buf, value)
+}
+
+func putBytesField(buf *bytes.Buffer, field int, value []byte) {
+	putKey(buf, field, 2)
+	putVarint(buf, uint64(len(value)))
+	buf.Write(value)
+}
+
+func putFixed32Field(buf *bytes.Buffer, field int, value uint32) {
+	putKey(buf, field, 5)
+	temp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(temp, value)
+	buf.Write(temp)
+}
+
+func controlFrame(controltype uint32, withContentType bool) []byte {
+	payload := new(bytes.Buffer)
+	temp := make([]byte, 4)
+	binary.BigEndian.PutUint32(temp, controltype)
+	payload.Write(temp)
+	if withContentType {
+		binary.BigEndian.PutUint32(temp, fieldContentType)
+		payload.Write(temp)
+		binary.BigEndian.PutUint32(temp, uint32(len(contentType)))
+		payload.Write(temp)
+		payload.WriteString(contentType)
+	}
+	frame := new(bytes.Buffer)
+	frame.Write([]byte{0, 0, 0, 0}) // Escape: a control frame follows
+	binary.BigEndian.PutUint32(temp, uint32(payload.Len()))
+	frame.Write(temp)
+	frame.Write(payload.Bytes())
+	return frame.Bytes()
+}
+
+func newWriter(output io.WriteCloser, identity string, version string) (*Writer, os.Error) {
+	_, error := output.Write(controlFrame(controlStart, true))
+	if error != nil {
+		output.Close()
+		return nil, error
+	}
+	writer := &Writer{output: output, queue: make(chan []byte, queueSize),
+		identity: identity, version: version, done: make(chan bool)}
+	go writer.run()
+	return writer, nil
+}
+
+// identity and version are the fields of the same name of the dnstap
+// messages, typically the server name and the software
+func NewFile(filename string, identity string, version string) (*Writer, os.Error) {
+	file, error := os.Open(filename, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+	if error != nil {
+		return nil, error
+	}
+	return newWriter(file, identity, version)
+}
+
+// A Unix socket uses the bidirectional mode of Frame Streams: we
+// announce the content type (READY) and the reader must accept it
+// (ACCEPT) before we start.
+func NewUnix(path string, identity string, version string) (*Writer, os.Error) {
+	conn, error := net.Dial("unix", "", path)
+	if error != nil {
+		return nil, error
+	}
+	_, error = conn.Write(controlFrame(controlReady, true))
+	if error != nil {
+		conn.Close()
+		return nil, error
+	}
+	header := make([]byte, 12) // Escape, length, type
+	_, error = io.ReadFull(conn, header)
+	if error == nil {
+		length := binary.BigEndian.Uint32(header[4:8])
+		if binary.BigEndian.Uint32(header[0:4]) != 0 || length < 4 || length > 512 ||
+			binary.BigEndian.Uint32(header[8:12]) != controlAccept {
+			error = os.NewError("the dnstap reader did not send an ACCEPT frame")
+		} else {
+			_, error = io.ReadFull(conn, make([]byte, length-4)) // The content types
+		}
+	}
+	if error != nil {
+		conn.Close()
+		return nil, error
+	}
+	return newWriter(conn, identity, version)
+}
+
+func (writer *Writer) run() {
+	length := make([]byte, 4)
+	for frame := range writer.queue {
+		binary.BigEndian.PutUint32(length, uint32(len(frame)))
+		_, error := writer.output.Write(length)
+		if error == nil {
+			_, error = writer.output.Write(frame)
+		}
+		if error != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write dnstap data, stopping: %s\n", error)
+			writer.output.Close()
+			for _ = range writer.queue { // Drop everything from now on
+				writer.countDrop()
+			}
+			writer.done <- true
+			return
+		}
+	}
+	writer.output.Write(controlFrame(controlStop, false))
+	writer.output.Close()
+	writer.done <- true
+}
+
+func (writer *Writer) countDrop() {
+	writer.mutex.Lock()
+	writer.dropped++
+	writer.mutex.Unlock()
+}
+
+// The number of messages which could not be queued or written
+func (writer *Writer) Dropped() uint64 {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	return writer.dropped
+}
+
+func enqueue(writer *Writer, frame []byte) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if writer.closed {
+		writer.dropped++
+		return
+	}
+	select {
+	case writer.queue <- frame:
+	default:
+		writer.dropped++
+	}
+}
+
+func address(addr net.Addr) (ip net.IP, port int) {
+	udpAddr, error := net.ResolveUDPAddr(addr.String())
+	if error != nil {
+		return nil, 0
+	}
+	return udpAddr.IP, udpAddr.Port
+}
+
+// Encodes a Dnstap message of type MESSAGE. Times are in nanoseconds
+// since the epoch, responseTime is 0 for a query.
+func encode(writer *Writer, messagetype uint64, client net.Addr, local net.Addr, transport string,
+	queryTime int64, query []byte, responseTime int64, response []byte) []byte {
+	message := new(bytes.Buffer)
+	putVarintField(message, 1, messagetype)
+	clientip, clientport := address(client)
+	localip, localport := address(local)
+	if clientip.To4() != nil {
+		putVarintField(message, 2, familyInet)
+		clientip = clientip.To4()
+		if localip.To4() != nil {
+			localip = localip.To4()
+		}
+	} else {
+		putVarintField(message, 2, familyInet6)
+	}
+	switch transport {
+	case "tcp":
+		putVarintField(message, 3, protocolTCP)
+	case "tls":
+		putVarintField(message, 3, protocolDOT)
+	case "https", "http":
+		putVarintField(message, 3, protocolDOH)
+	default:
+		putVarintField(message, 3, protocolUDP)
+	}
+	putBytesField(message, 4, clientip)
+	if localip != nil && !localip.Equal(net.IPv4zero) && !localip.Equal(net.IPv6unspecified) {
+		putBytesField(message, 5, localip)
+	}
+	putVarintField(message, 6, uint64(clientport))
+	putVarintField(message, 7, uint64(localport))
+	putVarintField(message, 8, uint64(queryTime/1e9))
+	putFixed32Field(message, 9, uint32(queryTime%1e9))
+	if messagetype == messageAuthQuery {
+		putBytesField(message, 10, query)
+	} else {
+		putVarintField(message, 12, uint64(responseTime/1e9))
+		putFixed32Field(message, 13, uint32(responseTime%1e9))
+		putBytesField(message, 14, response)
+	}
+	dnstap := new(bytes.Buffer)
+	putBytesField(dnstap, 1, []byte(writer.identity))
+	putBytesField(dnstap, 2, []byte(writer.version))
+	putBytesField(dnstap, 14, message.Bytes())
+	putVarintField(dnstap, 15, dnstapMessage)
+	return dnstap.Bytes()
+}
+
+// Logs a query and its response (nil if none was sent). The messages
+// are copied, the caller may reuse its buffers.
+func (writer *Writer) Log(client net.Addr, local net.Addr, transport string,
+	queryTime int64, query []byte, responseTime int64, response []byte) {
+	enqueue(writer, encode(writer, messageAuthQuery, client, local, transport,
+		queryTime, query, 0, nil))
+	if response != nil {
+		enqueue(writer, encode(writer, messageAuthResponse, client, local, transport,
+			queryTime, nil, responseTime, response))
+	}
+}
+
+// Writes the messages still in the queue, then the STOP frame. The
+// messages logged afterwards are dropped.
+func (writer *Writer) Close() {
+	writer.mutex.Lock()
+	writer.closed = true
+	close(writer.queue)
+	writer.mutex.Unlock()
+	<-writer.done
+}
@@ -0,0 +1,247 @@
+/* A name server which gives different addresses depending on the
+location of the client, found in a MaxMind DB file (GeoLite2-Country,
+GeoIP2-City, DB-IP...). If the query has a valid EDNS Client Subnet
+option (RFC 7871), its address is used, instead of the one of the
+resolver, and the scope sent back is the prefix length of the
+database entry.
+
+The configuration file has one line per set of addresses:
+
+ # name region address...
+ www.example.net country:FR 192.0.2.1 2001:db8::1
+ www.example.net continent:EU 192.0.2.2
+ www.example.net default 192.0.2.3 2001:db8::3
+
+The set of the country of the client is used, else the one of its
+continent, else the default one. Names without a default set get an
+empty answer for the clients of the other regions.
+
+A TXT query for the -debugname tells how the client was located.
+
+Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+
+ Example of use:
+
+ grong -servername "ns1.example.net" -- -mmdb GeoLite2-Country.mmdb -config geoip.conf -debugname whereami.example.net
+
+ dig @ns1.example.net +subnet=192.0.2.0/24 whereami.example.net TXT
+
+*/
+
+package responder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"./mmdb"
+	"./myflag"
+	"./types"
+)
+
+var (
+	database   *mmdb.Database
+	addresses  map[string]map[string][]net.IP // By name, then by region
+	dataMutex  sync.RWMutex                   // Protects database and addresses, replaced by Reload
+	debugName  string                         // "" if none
+	ttl        uint32
+	mmdbFile   string
+	configFile string
+)
+
+func canonical(name string) string {
+	name = strings.ToLower(name)
+	if len(name) > 1 && name[len(name)-1] == '.' {
+		name = name[0 : len(name)-1]
+	}
+	return name
+}
+
+func readConfig(filename string) (map[string]map[string][]net.IP, os.Error) {
+	content, error := ioutil.ReadFile(filename)
+	if error != nil {
+		return nil, error
+	}
+	result := make(map[string]map[string][]net.IP)
+	for linenum, line := range strings.Split(string(content), "\n", -1) {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, os.NewError(fmt.Sprintf("%s:%d: name, region and addresses expected",
+				filename, linenum+1))
+		}
+		region := fields[1]
+		if region != "default" && !strings.HasPrefix(region, "country:") &&
+			!strings.HasPrefix(region, "continent:") {
+			return nil, os.NewError(fmt.Sprintf("%s:%d: invalid region %s", filename, linenum+1, region))
+		}
+		ips := make([]net.IP, len(fields)-2)
+		for i, text := range fields[2:] {
+			ips[i] = net.ParseIP(text)
+			if ips[i] == nil {
+				return nil, os.NewError(fmt.Sprintf("%s:%d: invalid address %s", filename, linenum+1, text))
+			}
+		}
+		name := canonical(fields[0])
+		if result[name] == nil {
+			result[name] = make(map[string][]net.IP)
+		}
+		result[name][region] = ips
+	}
+	return result, nil
+}
+
+// The location of the client
+type location struct {
+	country, continent string // "" if unknown
+	ecs                bool   // Found from ECS
+	scope              uint8  // The prefix length of the database entry
+}
+
+func locate(database *mmdb.Database, query types.DNSquery) (result location) {
+	var ip net.IP
+	if query.EcsAddress != nil && query.EcsSource > 0 {
+		ip = query.EcsAddress
+		result.ecs = true
+	} else {
+		tcpAddr, _ := net.ResolveTCPAddr(query.Client.String())
+		ip = tcpAddr.IP
+	}
+	record, prefixLength, found, error := database.Lookup(ip)
+	if error != nil {
+		fmt.Fprintf(os.Stderr, "Cannot find %s in the database: %s\n", ip, error)
+	}
+	result.scope = uint8(prefixLength)
+	if found {
+		result.country, _ = mmdb.Path(record, "country", "iso_code").(string)
+		result.continent, _ = mmdb.Path(record, "continent", "code").(string)
+	}
+	return
+}
+
+// The region whose addresses are used for this name
+func region(sets map[string][]net.IP, where location) string {
+	for _, candidate := range []string{"country:" + where.country, "continent:" + where.continent} {
+		if sets[candidate] != nil {
+			return candidate
+		}
+	}
+	return "default"
+}
+
+func txt(qname string, text string) types.RR {
+	return types.RR{Name: qname, Type: types.TXT, Class: types.IN, TTL: 0,
+		Data: types.ToTXT(text)}
+}
+
+func Respond(query types.DNSquery, config map[string]interface{}) (result types.DNSresponse) {
+	dataMutex.RLock()
+	currentDatabase := database
+	sets, exists := addresses[query.Qname]
+	dataMutex.RUnlock()
+	if query.Qclass != types.IN || (!exists && query.Qname != debugName) {
+		result.Responsecode = types.REFUSED
+		result.Cacheable = true
+		return
+	}
+	where := locate(currentDatabase, query)
+	result.Responsecode = types.NOERROR
+	result.Authoritative = true
+	result.EcsUsed = where.ecs
+	result.EcsScope = where.scope
+	if query.Qname == debugName {
+		if query.Qtype == types.TXT || query.Qtype == types.ALL {
+			source := "client"
+			if where.ecs {
+				source = "ecs"
+			}
+			result.Ansection = []types.RR{
+				txt(query.Qname, "source="+source),
+				txt(query.Qname, fmt.Sprintf("prefix=%d", where.scope)),
+				txt(query.Qname, "country="+where.country),
+				txt(query.Qname, "continent="+where.continent)}
+		}
+		return
+	}
+	chosen := sets[region(sets, where)]
+	result.Ansection = make([]types.RR, 0, len(chosen))
+	for _, ip := range chosen {
+		rr := types.RR{Name: query.Qname, Class: types.IN, TTL: ttl}
+		if ip.To4() != nil {
+			rr.Type = types.A
+			rr.Data = ip.To4()
+		} else {
+			rr.Type = types.AAAA
+			rr.Data = ip
+		}
+		if rr.Type == query.Qtype || query.Qtype == types.ALL {
+			result.Ansection = result.Ansection[0 : len(result.Ansection)+1]
+			result.Ansection[len(result.Ansection)-1] = rr
+		}
+	}
+	return
+}
+
+// Reads the database and the configuration. The current ones are
+// replaced only if both are fine.
+func load() os.Error {
+	newdatabase, error := mmdb.Open(mmdbFile)
+	if error != nil {
+		return error
+	}
+	newaddresses, error := readConfig(configFile)
+	if error != nil {
+		return error
+	}
+	dataMutex.Lock()
+	database = newdatabase
+	addresses = newaddresses
+	dataMutex.Unlock()
+	return nil
+}
+
+func Reload() {
+	error := load()
+	if error != nil {
+		fmt.Fprintf(os.Stderr, "Cannot reload, keeping the old data: %s\n", error)
+	}
+}
+
+func Init(firstoption int) {
+	flag.Reinit(firstoption)
+	helpptr := flag.Bool("help", false, "Displays usage instructions")
+	mmdbptr := flag.String("mmdb", "", "Set the MaxMind DB file (mandatory)")
+	configptr := flag.String("config", "", "Set the file of the addresses per name and region (mandatory)")
+	debugnameptr := flag.String("debugname", "",
+		"Set the name whose TXT record tells how the client was located (default: none)")
+	ttlptr := flag.Int("ttl", 60, "Set the TTL of the answers")
+	flag.Parse()
+	if *helpptr {
+		fmt.Printf("Usage of the GeoIP responder:\n")
+		flag.PrintDefaults()
+		os.Exit(0)
+	}
+	if *mmdbptr == "" || *configptr == "" {
+		fmt.Fprintf(os.Stderr, "The GeoIP responder needs the -mmdb and -config options\n")
+		os.Exit(1)
+	}
+	if *ttlptr < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid TTL\n")
+		os.Exit(1)
+	}
+	mmdbFile = *mmdbptr
+	configFile = *configptr
+	debugName = canonical(*debugnameptr)
+	ttl = uint32(*ttlptr)
+	error := load()
+	if error != nil {
+		fmt.Fprintf(os.Stderr, "Cannot start the GeoIP responder: %s\n", error)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,437 @@
+/* A name server for load balancing: the addresses of a name come from
+a pool of backends, with weights, and the backends which fail their
+health check are removed from the answers. If all the backends of a
+name are down, all are returned anyway, an empty answer would be
+worse.
+
+The configuration file has one line per backend:
+
+ # name weight address check
+ www.example.net 3 192.0.2.1 tcp:80
+ www.example.net 1 192.0.2.2 http:80/health
+ www.example.net 1 2001:db8::1 none
+
+The check "tcp:PORT" connects to the port, "http:PORT/PATH" requests
+the path and wants a 200 status code, "none" never fails. A backend
+is down after -fall failed checks in a row and up again after -rise
+successful ones.
+
+The order of the addresses changes for every query: with -order
+shuffle, it is random, each backend having a chance proportional to
+its weight of being first (then second, etc); with -order rotate, the
+first one is chosen by a smooth weighted round-robin, like the one of
+nginx, and the others follow in the order of the file. -answers
+limits the number of addresses returned.
+
+Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+
+ Example of use:
+
+ grong -servername "ns1.example.net" -- -config lb.conf -interval 10 -answers 2
+
+ To test with local servers as backends:
+
+ python3 -m http.server --bind 127.0.0.1 8080 (and 8081, etc)
+
+ with "www.example.net 1 127.0.0.1 http:8080/" in the configuration
+ (the same address, with different ports, makes different backends)
+
+*/
+
+package responder
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"./metrics"
+	"./myflag"
+	"./types"
+)
+
+type backend struct {
+	address net.IP
+	weight  int
+	check   string // "tcp:80", "http:80/health" or "none"
+	key     string // To keep the state across reloads
+}
+
+// The health and the round-robin state of a backend
+type state struct {
+	up                  bool
+	failures, successes int  // In a row
+	current             int  // Of the smooth weighted round-robin
+	checking            bool // A check is running, do not start another
+}
+
+var (
+	pools       map[string][]*backend // By name, in the order of the file
+	states      map[string]*state     // By backend key
+	statesMutex sync.Mutex            // Protects states and their content
+	configFile  string
+	shuffle     bool
+	answers     int // 0 if all
+	ttl         uint32
+	interval    int64 // In nanoseconds
+	timeout     int64
+	fall, rise  int
+)
+
+var transitions = metrics.NewCounter("grong_lb_transitions_total",
+	"Backends going down or up", "backend", "state")
+
+func canonical(name string) string {
+	name = strings.ToLower(name)
+	if len(name) > 1 && name[len(name)-1] == '.' {
+		name = name[0 : len(name)-1]
+	}
+	return name
+}
+
+func readConfig(filename string) (map[string][]*backend, os.Error) {
+	content, error := ioutil.ReadFile(filename)
+	if error != nil {
+		return nil, error
+	}
+	result := make(map[string][]*backend)
+	for linenum, line := range strings.Split(string(content), "\n", -1) {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		where := fmt.Sprintf("%s:%d", filename, linenum+1)
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, os.NewError(where + ": name, weight, address and check expected")
+		}
+		weight, error := strconv.Atoi(fields[1])
+		if error != nil || weight < 1 {
+			return nil, os.NewError(where + ": invalid weight " + fields[1])
+		}
+		address := net.ParseIP(fields[2])
+		if address == nil {
+			return nil, os.NewError(where + ": invalid address " + fields[2])
+		}
+		check := fields[3]
+		if check != "none" && !strings.HasPrefix(check, "tcp:") && !strings.HasPrefix(check, "http:") {
+			return nil, os.NewError(where + ": invalid check " + check)
+		}
+		name := canonical(fields[0])
+		b := &backend{address: address, weight: weight, check: check,
+			key: name + "/" + fields[2] + "/" + check}
+		pool := result[name]
+		newpool := make([]*backend, len(pool)+1)
+		copy(newpool, pool)
+		newpool[len(pool)] = b
+		result[name] = newpool
+	}
+	return result, nil
+}
+
+// "host:port", with the brackets for IPv6
+func hostPort(address net.IP, port string) string {
+	if address.To4() != nil {
+		return address.String() + ":" + port
+	}
+	return "[" + address.String() + "]:" + port
+}
+
+type dialResult struct {
+	conn  net.Conn
+	error os.Error
+}
+
+// net.Dial has no timeout (a blackholed backend would take the TCP
+// timeout of the system, about two minutes on Linux), so it runs in
+// its own goroutine. If it is too slow, we stop waiting and the
+// goroutine closes the connection if it comes later.
+func dial(address string) (net.Conn, os.Error) {
+	results := make(chan dialResult, 1)
+	go func() {
+		conn, error := net.Dial("tcp", "", address)
+		results <- dialResult{conn, error}
+	}()
+	select {
+	case result := <-results:
+		return result.conn, result.error
+	case <-time.After(timeout):
+	}
+	go func() {
+		result := <-results
+		if result.conn != nil {
+			result.conn.Close()
+		}
+	}()
+	return nil, os.NewError("timeout when connecting to " + address)
+}
+
+// Runs the check once. The connect and each read and write have
+// -timeout, so a slow backend fails the check instead of keeping it.
+// The HTTP check is a plain HTTP/1.0 request, to keep the control of
+// the connection.
+func runCheck(b *backend) bool {
+	if b.check == "none" {
+		return true
+	}
+	port := b.check[4:]
+	path := ""
+	if strings.HasPrefix(b.check, "http:") {
+		port = b.check[5:]
+		path = "/"
+		slash := strings.Index(port, "/")
+		if slash >= 0 {
+			path = port[slash:]
+			port = port[0:slash]
+		}
+	}
+	conn, error := dial(hostPort(b.address, port))
+	if error != nil {
+		return false
+	}
+	defer conn.Close()
+	if path == "" { // tcp:
+		return true
+	}
+	conn.SetReadTimeout(timeout)
+	conn.SetWriteTimeout(timeout)
+	_, error = conn.Write([]byte("GET " + path + " HTTP/1.0\r\n" +
+		"Host: " + hostPort(b.address, port) + "\r\n" +
+		"User-Agent: GRONG health check\r\n\r\n"))
+	if error != nil {
+		return false
+	}
+	status, error := bufio.NewReader(conn).ReadString('\n')
+	if error != nil {
+		return false
+	}
+	fields := strings.Fields(status) // "HTTP/1.1 200 OK"
+	return len(fields) >= 2 && strings.HasPrefix(fields[0], "HTTP/") && fields[1] == "200"
+}
+
+func record(b *backend, ok bool) {
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	s := states[b.key]
+	if s == nil { // Removed by a reload in the mean time
+		return
+	}
+	s.checking = false
+	if ok {
+		s.failures = 0
+		s.successes++
+		if !s.up && s.successes >= rise {
+			s.up = true
+			transitions.Inc(b.key, "up")
+		}
+	} else {
+		s.successes = 0
+		s.failures++
+		if s.up && s.failures >= fall {
+			s.up = false
+			transitions.Inc(b.key, "down")
+		}
+	}
+}
+
+// Checks all the backends, every interval, forever
+func checker() {
+	for {
+		statesMutex.Lock()
+		for _, pool := range pools {
+			for _, b := range pool {
+				s := states[b.key]
+				if s == nil || s.checking { // The previous check is still running
+					continue
+				}
+				s.checking = true
+				go func(b *backend) {
+					record(b, runCheck(b))
+				}(b)
+			}
+		}
+		statesMutex.Unlock()
+		time.Sleep(interval)
+	}
+}
+
+// The backends of the pool which answer this type, the ones which are
+// up or, if none is, all of them
+func candidates(pool []*backend, qtype uint16) []*backend {
+	all := make([]*backend, 0, len(pool))
+	up := make([]*backend, 0, len(pool))
+	for _, b := range pool {
+		isv4 := b.address.To4() != nil
+		if qtype != types.ALL && (qtype == types.A) != isv4 {
+			continue
+		}
+		all = all[0 : len(all)+1]
+		all[len(all)-1] = b
+		if states[b.key].up {
+			up = up[0 : len(up)+1]
+			up[len(up)-1] = b
+		}
+	}
+	if len(up) == 0 {
+		return all
+	}
+	return up
+}
+
+// Random order, weighted: each position is drawn among the remaining
+// backends with a probability proportional to their weight
+func weightedShuffle(list []*backend) {
+	total := 0
+	for _, b := range list {
+		total += b.weight
+	}
+	for i := range list {
+		draw := rand.Intn(total)
+		j := i
+		for ; draw >= list[j].weight; j++ {
+			draw -= list[j].weight
+		}
+		list[i], list[j] = list[j], list[i]
+		total -= list[i].weight
+	}
+}
+
+// Smooth weighted round-robin: every backend gains its weight, the
+// richest one is chosen and pays the total
+func rotate(list []*backend) {
+	total := 0
+	best := 0
+	for i, b := range list {
+		s := states[b.key]
+		s.current += b.weight
+		total += b.weight
+		if s.current > states[list[best].key].current {
+			best = i
+		}
+	}
+	states[list[best].key].current -= total
+	rotated := make([]*backend, len(list))
+	copy(rotated, list[best:])
+	copy(rotated[len(list)-best:], list[0:best])
+	copy(list, rotated)
+}
+
+func Respond(query types.DNSquery, config map[string]interface{}) (result types.DNSresponse) {
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	pool, exists := pools[query.Qname]
+	if query.Qclass != types.IN || !exists {
+		result.Responsecode = types.REFUSED
+		result.Cacheable = true
+		return
+	}
+	result.Responsecode = types.NOERROR
+	result.Authoritative = true
+	if query.Qtype != types.A && query.Qtype != types.AAAA && query.Qtype != types.ALL {
+		result.Cacheable = true
+		return
+	}
+	list := candidates(pool, query.Qtype)
+	if len(list) > 0 {
+		if shuffle {
+			weightedShuffle(list)
+		} else {
+			rotate(list)
+		}
+	}
+	if answers > 0 && len(list) > answers {
+		list = list[0:answers]
+	}
+	result.Ansection = make([]types.RR, len(list))
+	for i, b := range list {
+		result.Ansection[i] = types.RR{Name: query.Qname, Class: types.IN, TTL: ttl}
+		if b.address.To4() != nil {
+			result.Ansection[i].Type = types.A
+			result.Ansection[i].Data = b.address.To4()
+		} else {
+			result.Ansection[i].Type = types.AAAA
+			result.Ansection[i].Data = b.address
+		}
+	}
+	return
+}
+
+// Reads the configuration. The backends which were already known keep
+// their state, the new ones start up (until they fail their checks).
+func load() os.Error {
+	newpools, error := readConfig(configFile)
+	if error != nil {
+		return error
+	}
+	newstates := make(map[string]*state)
+	statesMutex.Lock()
+	for _, pool := range newpools {
+		for _, b := range pool {
+			s, exists := states[b.key]
+			if !exists {
+				s = &state{up: true}
+			}
+			newstates[b.key] = s
+		}
+	}
+	states = newstates
+	pools = newpools
+	statesMutex.Unlock()
+	return nil
+}
+
+func Reload() {
+	error := load()
+	if error != nil {
+		fmt.Fprintf(os.Stderr, "Cannot reload the configuration, keeping the old one: %s\n", error)
+	}
+}
+
+func Init(firstoption int) {
+	flag.Reinit(firstoption)
+	helpptr := flag.Bool("help", false, "Displays usage instructions")
+	configptr := flag.String("config", "", "Set the file of the backends (mandatory)")
+	orderptr := flag.String("order", "shuffle", "Set the order of the addresses, shuffle or rotate")
+	answersptr := flag.Int("answers", 0, "Set the maximum number of addresses in an answer (default: all)")
+	ttlptr := flag.Int("ttl", 30, "Set the TTL of the answers")
+	intervalptr := flag.Int("interval", 10, "Set the time between two health checks, in seconds")
+	timeoutptr := flag.Int("timeout", 3, "Set the time after which a health check fails, in seconds")
+	fallptr := flag.Int("fall", 3, "Set the number of failed checks in a row for a backend to be down")
+	riseptr := flag.Int("rise", 2, "Set the number of successful checks in a row for a backend to be up again")
+	flag.Parse()
+	if *helpptr {
+		fmt.Printf("Usage of the load-balancing responder:\n")
+		flag.PrintDefaults()
+		os.Exit(0)
+	}
+	if *configptr == "" {
+		fmt.Fprintf(os.Stderr, "The load-balancing responder needs a -config option\n")
+		os.Exit(1)
+	}
+	if (*orderptr != "shuffle" && *orderptr != "rotate") || *answersptr < 0 || *ttlptr < 0 ||
+		*intervalptr < 1 || *timeoutptr < 1 || *fallptr < 1 || *riseptr < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid options\n")
+		os.Exit(1)
+	}
+	configFile = *configptr
+	shuffle = *orderptr == "shuffle"
+	answers = *answersptr
+	ttl = uint32(*ttlptr)
+	interval = int64(*intervalptr) * 1e9
+	timeout = int64(*timeoutptr) * 1e9
+	fall = *fallptr
+	rise = *riseptr
+	rand.Seed(time.Nanoseconds())
+	error := load()
+	if error != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read the configuration: %s\n", error)
+		os.Exit(1)
+	}
+	go checker()
+}
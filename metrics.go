@@ -0,0 +1,210 @@
+/* Metrics in the text format of Prometheus
+   <https://prometheus.io/docs/instrumenting/exposition_formats/>,
+   served over HTTP.
+
+   The metrics are registered when they are created, by the server or
+   by the responder (so it can export its own metrics), and are all
+   written, in the order of creation, when /metrics is requested.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"http"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registry      = make([]metric, 0, 32)
+	registryMutex sync.Mutex
+)
+
+func register(m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if len(registry) == cap(registry) {
+		newregistry := make([]metric, len(registry), 2*cap(registry))
+		copy(newregistry, registry)
+		registry = newregistry
+	}
+	registry = registry[0 : len(registry)+1]
+	registry[len(registry)-1] = m
+}
+
+func escape(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return strings.Replace(value, "\n", "\\n", -1)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// A counter, possibly with labels (one counter per combination of
+// their values)
+type Counter struct {
+	name    string
+	help    string
+	labels  []string
+	entries map[string]*counterEntry // Indexed by the values of the labels, see Add
+	mutex   sync.Mutex
+}
+
+type counterEntry struct {
+	values []string // In the order of the labels
+	count  uint64
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	counter := &Counter{name: name, help: help, labels: labels,
+		entries: make(map[string]*counterEntry)}
+	register(counter)
+	return counter
+}
+
+// Adds one, for these values of the labels (in the order given to
+// NewCounter)
+func (counter *Counter) Inc(values ...string) {
+	counter.Add(1, values...)
+}
+
+// Since it is called for every query, the key is built in a buffer on
+// the stack, from the raw values separated by 0xFF (which is never in
+// a label value, they must be UTF-8), and formatted only by write.
+func (counter *Counter) Add(delta uint64, values ...string) {
+	if len(values) > len(counter.labels) {
+		values = values[0:len(counter.labels)]
+	}
+	size := len(counter.labels) // The missing values are ""
+	for _, value := range values {
+		size += len(value)
+	}
+	var buffer [256]byte
+	var key []byte
+	if size <= len(buffer) {
+		key = buffer[0:size]
+	} else {
+		key = make([]byte, size)
+	}
+	position := 0
+	for i := range counter.labels {
+		if i < len(values) {
+			position += copy(key[position:], values[i])
+		}
+		key[position] = 0xFF
+		position++
+	}
+	counter.mutex.Lock()
+	entry, exists := counter.entries[string(key)]
+	if !exists {
+		entry = &counterEntry{values: make([]string, len(counter.labels))}
+		copy(entry.values, values)
+		counter.entries[string(key)] = entry
+	}
+	entry.count += delta
+	counter.mutex.Unlock()
+}
+
+func (counter *Counter) write(w io.Writer) {
+	writeHeader(w, counter.name, counter.help, "counter")
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	for _, entry := range counter.entries {
+		if len(counter.labels) == 0 {
+			fmt.Fprintf(w, "%s %d\n", counter.name, entry.count)
+			continue
+		}
+		text := make([]string, len(counter.labels))
+		for i, label := range counter.labels {
+			text[i] = fmt.Sprintf("%s=\"%s\"", label, escape(entry.values[i]))
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", counter.name, strings.Join(text, ","), entry.count)
+	}
+}
+
+// A counter kept elsewhere, read when the metrics are requested
+type CounterFunc struct {
+	name  string
+	help  string
+	value func() uint64
+}
+
+func NewCounterFunc(name string, help string, value func() uint64) *CounterFunc {
+	counter := &CounterFunc{name: name, help: help, value: value}
+	register(counter)
+	return counter
+}
+
+func (counter *CounterFunc) write(w io.Writer) {
+	writeHeader(w, counter.name, counter.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", counter.name, counter.value())
+}
+
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64 // Upper bounds, in increasing order
+	counts  []uint64  // One per bucket, plus +Inf
+	sum     float64
+	mutex   sync.Mutex
+}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	histogram := &Histogram{name: name, help: help, buckets: buckets,
+		counts: make([]uint64, len(buckets)+1)}
+	register(histogram)
+	return histogram
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	i := 0
+	for i < len(histogram.buckets) && value > histogram.buckets[i] {
+		i++
+	}
+	histogram.mutex.Lock()
+	histogram.counts[i]++
+	histogram.sum += value
+	histogram.mutex.Unlock()
+}
+
+func (histogram *Histogram) write(w io.Writer) {
+	writeHeader(w, histogram.name, histogram.help, "histogram")
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	var cumulative uint64
+	for i, bound := range histogram.buckets {
+		cumulative += histogram.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", histogram.name, bound, cumulative)
+	}
+	cumulative += histogram.counts[len(histogram.buckets)]
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", histogram.name, cumulative)
+	fmt.Fprintf(w, "%s_sum %g\n", histogram.name, histogram.sum)
+	fmt.Fprintf(w, "%s_count %d\n", histogram.name, cumulative)
+}
+
+func handler(w http.ResponseWriter, request *http.Request) {
+	w.SetHeader("Content-Type", "text/plain; version=0.0.4")
+	registryMutex.Lock()
+	metrics := registry
+	registryMutex.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Serves the metrics on /metrics. Does not return, except on error.
+func Serve(address string) os.Error {
+	http.HandleFunc("/metrics", handler)
+	return http.ListenAndServe(address, nil)
+}
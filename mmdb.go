@@ -0,0 +1,291 @@
+/* A reader of the MaxMind DB format (the .mmdb files of GeoLite2,
+   GeoIP2, DB-IP...), <https://maxmind.github.io/MaxMind-DB/>: a binary
+   search tree on the bits of the address, whose leaves point to
+   records in a data section, followed by the metadata.
+
+   The whole file is read in memory.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+)
+
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// The types of the data section
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEnd       = 13
+	typeBoolean   = 14
+	typeFloat     = 15
+)
+
+type Database struct {
+	Metadata   map[string]interface{}
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint // In bits: 24, 28 or 32
+	ipVersion  uint
+	ipv4Start  uint // The node of ::/96, where IPv4 addresses start
+}
+
+func Open(filename string) (*Database, os.Error) {
+	content, error := ioutil.ReadFile(filename)
+	if error != nil {
+		return nil, error
+	}
+	marker := bytes.LastIndex(content, metadataMarker)
+	if marker < 0 {
+		return nil, os.NewError(filename + ": not a MaxMind DB file")
+	}
+	db := new(Database)
+	metadata, _, error := decode(content[marker+len(metadataMarker):], 0)
+	if error != nil {
+		return nil, os.NewError(fmt.Sprintf("%s: invalid metadata: %s", filename, error))
+	}
+	var ok bool
+	db.Metadata, ok = metadata.(map[string]interface{})
+	if !ok {
+		return nil, os.NewError(filename + ": the metadata is not a map")
+	}
+	db.nodeCount = db.metadataInteger("node_count")
+	db.recordSize = db.metadataInteger("record_size")
+	db.ipVersion = db.metadataInteger("ip_version")
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, os.NewError(fmt.Sprintf("%s: unsupported record size %d", filename, db.recordSize))
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(marker) {
+		return nil, os.NewError(filename + ": search tree larger than the file")
+	}
+	db.tree = content[0:treeSize]
+	db.data = content[treeSize+16 : marker] // 16 bytes of zeroes between them
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+func (db *Database) metadataInteger(key string) uint {
+	switch value := db.Metadata[key].(type) {
+	case uint64:
+		return uint(value)
+	}
+	return 0
+}
+
+// One of the two records (bit is 0 for left, 1 for right) of a node
+func (db *Database) record(node uint, bit uint) uint {
+	bytesPerNode := db.recordSize / 4
+	n := db.tree[node*bytesPerNode : (node+1)*bytesPerNode]
+	switch db.recordSize {
+	case 24:
+		n = n[bit*3:]
+		return uint(n[0])<<16 | uint(n[1])<<8 | uint(n[2])
+	case 28:
+		if bit == 0 {
+			return uint(n[3]>>4)<<24 | uint(n[0])<<16 | uint(n[1])<<8 | uint(n[2])
+		}
+		return uint(n[3]&0x0F)<<24 | uint(n[4])<<16 | uint(n[5])<<8 | uint(n[6])
+	}
+	return uint(binary.BigEndian.Uint32(n[bit*4:]))
+}
+
+// Returns the record of the address, and the length of the prefix
+// which has this record (so all the addresses of this prefix give the
+// same result). found is false if the address is not in the database.
+func (db *Database) Lookup(ip net.IP) (record interface{}, prefixLength int, found bool, error os.Error) {
+	address := ip.To4()
+	node := uint(0)
+	if address == nil {
+		if db.ipVersion == 4 {
+			return nil, 0, false, nil // No IPv6 in this database
+		}
+		address = ip.To16()
+	} else if db.ipVersion == 6 {
+		node = db.ipv4Start
+	}
+	depth := 0
+	for ; depth < 8*len(address) && node < db.nodeCount; depth++ {
+		bit := uint(address[depth/8]>>uint(7-depth%8)) & 1
+		node = db.record(node, bit)
+	}
+	if node == db.nodeCount { // No data
+		return nil, depth, false, nil
+	}
+	if node < db.nodeCount {
+		return nil, 0, false, os.NewError("search tree deeper than the address")
+	}
+	offset := node - db.nodeCount - 16
+	if offset >= uint(len(db.data)) {
+		return nil, 0, false, os.NewError("invalid pointer in the search tree")
+	}
+	record, _, error = decode(db.data, offset)
+	if error != nil {
+		return nil, 0, false, error
+	}
+	return record, depth, true, nil
+}
+
+// Follows a path of keys in nested maps, for instance "country",
+// "iso_code". Returns nil if it does not exist.
+func Path(record interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		record = m[key]
+	}
+	return record
+}
+
+func unsigned(data []byte) (result uint64) {
+	for _, b := range data {
+		result = result<<8 | uint64(b)
+	}
+	return
+}
+
+// Decodes the value at offset in the data section. Returns it and the
+// offset of the next one. Maps become map[string]interface{}, arrays
+// []interface{}, strings string, unsigned integers uint64 (or []byte
+// for uint128), int32 int, double and float float64.
+func decode(data []byte, offset uint) (value interface{}, next uint, error os.Error) {
+	short := os.NewError("data section truncated")
+	if offset >= uint(len(data)) {
+		return nil, 0, short
+	}
+	control := data[offset]
+	offset++
+	kind := control >> 5
+	if kind == typePointer {
+		ss := uint(control>>3) & 0x03
+		if offset+ss+1 > uint(len(data)) {
+			return nil, 0, short
+		}
+		var pointer uint
+		switch ss {
+		case 0:
+			pointer = uint(control&0x07)<<8 | uint(data[offset])
+		case 1:
+			pointer = (uint(control&0x07)<<16 | uint(unsigned(data[offset:offset+2]))) + 2048
+		case 2:
+			pointer = (uint(control&0x07)<<24 | uint(unsigned(data[offset:offset+3]))) + 526336
+		case 3:
+			pointer = uint(unsigned(data[offset : offset+4]))
+		}
+		// The format forbids a pointer to a pointer, which would
+		// otherwise allow loops
+		if pointer >= uint(len(data)) {
+			return nil, 0, short
+		}
+		if data[pointer]>>5 == typePointer {
+			return nil, 0, os.NewError("pointer to a pointer in the data section")
+		}
+		value, _, error = decode(data, pointer)
+		return value, offset + ss + 1, error
+	}
+	if kind == typeExtended {
+		if offset >= uint(len(data)) {
+			return nil, 0, short
+		}
+		kind = data[offset] + 7
+		offset++
+	}
+	size := uint(control & 0x1F)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(data)) {
+			return nil, 0, short
+		}
+		base := map[uint]uint{1: 29, 2: 285, 3: 65821}[extra]
+		size = base + uint(unsigned(data[offset:offset+extra]))
+		offset += extra
+	}
+	switch kind {
+	case typeMap:
+		result := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, item interface{}
+			key, offset, error = decode(data, offset)
+			if error != nil {
+				return nil, 0, error
+			}
+			item, offset, error = decode(data, offset)
+			if error != nil {
+				return nil, 0, error
+			}
+			skey, ok := key.(string)
+			if !ok {
+				return nil, 0, os.NewError("map key is not a string")
+			}
+			result[skey] = item
+		}
+		return result, offset, nil
+	case typeArray:
+		result := make([]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			result[i], offset, error = decode(data, offset)
+			if error != nil {
+				return nil, 0, error
+			}
+		}
+		return result, offset, nil
+	case typeBoolean:
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(data)) {
+		return nil, 0, short
+	}
+	content := data[offset : offset+size]
+	next = offset + size
+	switch kind {
+	case typeString:
+		return string(content), next, nil
+	case typeBytes, typeUint128:
+		return content, next, nil
+	case typeUint16, typeUint32, typeUint64:
+		return unsigned(content), next, nil
+	case typeInt32:
+		return int(int32(unsigned(content))), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, os.NewError("invalid double")
+		}
+		return math.Float64frombits(unsigned(content)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, os.NewError("invalid float")
+		}
+		return float64(math.Float32frombits(uint32(unsigned(content)))), next, nil
+	}
+	return nil, 0, os.NewError(fmt.Sprintf("unsupported data type %d", kind))
+}
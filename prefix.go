@@ -0,0 +1,114 @@
+/* IP prefixes ("192.0.2.0/24", "2001:db8::/32"), for the options
+   which trust or restrict some clients.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package prefix
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Prefix struct {
+	ip   net.IP // Always in the 16-byte form
+	bits int    // IPv4 prefixes are counted from the IPv4-mapped form
+}
+
+// Parses "address/length" or just an address (then, the length is the
+// whole address)
+func Parse(text string) (prefix Prefix, error os.Error) {
+	address := text
+	length := -1
+	slash := strings.Index(text, "/")
+	if slash >= 0 {
+		address = text[0:slash]
+		length, error = strconv.Atoi(text[slash+1:])
+		if error != nil {
+			return prefix, os.NewError(fmt.Sprintf("Invalid prefix length in %s", text))
+		}
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return prefix, os.NewError(fmt.Sprintf("Invalid address in %s", text))
+	}
+	max := 8 * net.IPv6len
+	offset := 0
+	if ip.To4() != nil && strings.Index(address, ":") < 0 {
+		max = 8 * net.IPv4len
+		offset = 8 * (net.IPv6len - net.IPv4len)
+	}
+	if length < 0 {
+		length = max
+	}
+	if length > max {
+		return prefix, os.NewError(fmt.Sprintf("Prefix length too large in %s", text))
+	}
+	return Prefix{ip: ip.To16(), bits: length + offset}, nil
+}
+
+// Parses a comma-separated list of prefixes. The empty string is the
+// empty list.
+func ParseList(text string) ([]Prefix, os.Error) {
+	if text == "" {
+		return []Prefix{}, nil
+	}
+	items := strings.Split(text, ",", -1)
+	result := make([]Prefix, len(items))
+	for i, item := range items {
+		var error os.Error
+		result[i], error = Parse(strings.TrimSpace(item))
+		if error != nil {
+			return nil, error
+		}
+	}
+	return result, nil
+}
+
+func (prefix Prefix) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	for i := 0; i < prefix.bits; i++ {
+		mask := byte(0x80 >> uint(i%8))
+		if ip[i/8]&mask != prefix.ip[i/8]&mask {
+			return false
+		}
+	}
+	return true
+}
+
+func (prefix Prefix) String() string {
+	bits := prefix.bits
+	if prefix.ip.To4() != nil {
+		bits -= 8 * (net.IPv6len - net.IPv4len)
+	}
+	return fmt.Sprintf("%s/%d", prefix.ip, bits)
+}
+
+// Tells if the address is in one of the prefixes
+func Match(prefixes []Prefix, ip net.IP) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The IP address of a client, whatever the transport, nil if there is
+// none
+func Address(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
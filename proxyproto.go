@@ -0,0 +1,196 @@
+/* The PROXY protocol of HAProxy, versions 1 (text) and 2 (binary),
+   <http://www.haproxy.org/download/2.0/doc/proxy-protocol.txt>: a TCP
+   load balancer sends, before the data, a header with the address of
+   the real client.
+
+   The header is read only from the trusted sources (the balancers),
+   where it is mandatory. Other connections are accepted unchanged.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package proxyproto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"./prefix"
+)
+
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n") // Version 2
+
+const maxV1 = 107 // Maximum length of a version 1 header, with the CRLF
+
+// A connection whose RemoteAddr is the one sent by the balancer
+type Conn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+type accepted struct {
+	conn  net.Conn
+	error os.Error
+}
+
+type Listener struct {
+	net.Listener
+	trusted  []prefix.Prefix
+	timeout  int64 // In nanoseconds, to read the header
+	accepted chan accepted
+	mutex    sync.Mutex // Protects failed
+	failed   uint64
+}
+
+// Wraps listener. The headers are read in their own goroutine so a
+// slow balancer does not block the others.
+func NewListener(listener net.Listener, trusted []prefix.Prefix, timeout int64) *Listener {
+	result := &Listener{Listener: listener, trusted: trusted, timeout: timeout,
+		accepted: make(chan accepted)}
+	go result.run()
+	return result
+}
+
+func (listener *Listener) run() {
+	for {
+		conn, error := listener.Listener.Accept()
+		if error != nil {
+			listener.accepted <- accepted{nil, error}
+			continue
+		}
+		go listener.handshake(conn)
+	}
+}
+
+func (listener *Listener) handshake(conn net.Conn) {
+	if !prefix.Match(listener.trusted, prefix.Address(conn.RemoteAddr())) {
+		listener.accepted <- accepted{conn, nil}
+		return
+	}
+	conn.SetReadTimeout(listener.timeout)
+	remote, error := readHeader(conn)
+	conn.SetReadTimeout(0)
+	if error != nil {
+		// Not returned by Accept, since http.Serve stops on errors
+		listener.mutex.Lock()
+		listener.failed++
+		listener.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	if remote == nil { // Health check of the balancer, or unknown protocol
+		remote = conn.RemoteAddr()
+	}
+	listener.accepted <- accepted{&Conn{conn, remote}, nil}
+}
+
+func (listener *Listener) Accept() (net.Conn, os.Error) {
+	result := <-listener.accepted
+	return result.conn, result.error
+}
+
+// Number of connections from trusted sources closed because of an
+// invalid or missing header
+func (listener *Listener) Failed() uint64 {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	return listener.failed
+}
+
+// Returns the address of the client, or nil if the balancer does not
+// give one (LOCAL command, UNKNOWN or non-IP family)
+func readHeader(conn net.Conn) (net.Addr, os.Error) {
+	header := make([]byte, 16)
+	_, error := io.ReadFull(conn, header[0:6])
+	if error != nil {
+		return nil, error
+	}
+	if string(header[0:6]) == "PROXY " {
+		return readV1(conn)
+	}
+	if !bytes.Equal(header[0:6], signature[0:6]) {
+		return nil, os.NewError("No PROXY header")
+	}
+	_, error = io.ReadFull(conn, header[6:16])
+	if error != nil {
+		return nil, error
+	}
+	if !bytes.Equal(header[0:12], signature) {
+		return nil, os.NewError("Invalid PROXY version 2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, os.NewError("Unsupported PROXY version")
+	}
+	command := header[12] & 0x0F
+	family := header[13] >> 4
+	length := int(header[14])<<8 | int(header[15])
+	body := make([]byte, length)
+	_, error = io.ReadFull(conn, body)
+	if error != nil {
+		return nil, error
+	}
+	switch command {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, os.NewError("Unsupported PROXY command")
+	}
+	switch family {
+	case 1: // AF_INET: source, destination, source port, destination port
+		if length < 12 {
+			return nil, os.NewError("PROXY version 2 header too short")
+		}
+		return &net.TCPAddr{IP: net.IPv4(body[0], body[1], body[2], body[3]),
+			Port: int(body[8])<<8 | int(body[9])}, nil
+	case 2: // AF_INET6
+		if length < 36 {
+			return nil, os.NewError("PROXY version 2 header too short")
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, body[0:16])
+		return &net.TCPAddr{IP: ip, Port: int(body[32])<<8 | int(body[33])}, nil
+	}
+	return nil, nil // AF_UNSPEC or AF_UNIX
+}
+
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n", "PROXY " already read
+func readV1(conn net.Conn) (net.Addr, os.Error) {
+	line := make([]byte, 0, maxV1)
+	onebyte := make([]byte, 1)
+	for {
+		if len(line) >= maxV1-6 {
+			return nil, os.NewError("PROXY version 1 header too long")
+		}
+		_, error := io.ReadFull(conn, onebyte) // Byte per byte, to not read the data after
+		if error != nil {
+			return nil, error
+		}
+		if onebyte[0] == '\n' {
+			break
+		}
+		line = line[0 : len(line)+1]
+		line[len(line)-1] = onebyte[0]
+	}
+	fields := strings.Split(strings.TrimRight(string(line), "\r"), " ", -1)
+	if fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, os.NewError("Invalid PROXY version 1 header")
+	}
+	ip := net.ParseIP(fields[1])
+	port, error := strconv.Atoi(fields[3])
+	if ip == nil || error != nil || port < 0 || port > 65535 {
+		return nil, os.NewError("Invalid address in PROXY version 1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
@@ -0,0 +1,145 @@
+/* A log of the queries, one line per query, in text or in JSON (one
+   object per line), to a file (rotated when it becomes too large) or
+   to syslog. It is independent of the debug level.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package querylog
+
+import (
+	"fmt"
+	"json"
+	"log"
+	"os"
+	"sync"
+	"syslog"
+	"time"
+)
+
+type Entry struct {
+	Time       string // RFC 3339, with milliseconds
+	Client     string
+	Transport  string
+	Qname      string
+	Qtype      string
+	Qclass     uint16
+	Rcode      string
+	Answers    int
+	Size       int // Of the response
+	Edns       bool
+	BufferSize uint16  // Of the query, if Edns
+	Dnssec     bool    // The DO bit
+	Latency    float64 // In milliseconds
+}
+
+type Logger struct {
+	json     bool
+	filename string
+	file     *os.File
+	maxSize  int64 // 0 if no rotation
+	keep     int   // Number of old files kept
+	size     int64
+	syslog   *log.Logger // Instead of file
+	mutex    sync.Mutex
+}
+
+func NewFile(filename string, json bool, maxSize int64, keep int) (*Logger, os.Error) {
+	logger := &Logger{json: json, filename: filename, maxSize: maxSize, keep: keep}
+	error := logger.open()
+	if error != nil {
+		return nil, error
+	}
+	return logger, nil
+}
+
+func NewSyslog(json bool) (*Logger, os.Error) {
+	logger := syslog.NewLogger(syslog.LOG_INFO, 0)
+	if logger == nil {
+		return nil, os.NewError("cannot connect to syslog")
+	}
+	return &Logger{json: json, syslog: logger}, nil
+}
+
+func (logger *Logger) open() os.Error {
+	file, error := os.Open(logger.filename, os.O_WRONLY|os.O_CREAT|os.O_APPEND, 0644)
+	if error != nil {
+		return error
+	}
+	info, error := file.Stat()
+	if error != nil {
+		file.Close()
+		return error
+	}
+	logger.file = file
+	logger.size = info.Size
+	return nil
+}
+
+// file becomes file.1, file.1 becomes file.2... and the oldest one is
+// deleted
+func (logger *Logger) rotate() os.Error {
+	logger.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", logger.filename, logger.keep))
+	for i := logger.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", logger.filename, i),
+			fmt.Sprintf("%s.%d", logger.filename, i+1))
+	}
+	if logger.keep > 0 {
+		os.Rename(logger.filename, logger.filename+".1")
+	} else {
+		os.Remove(logger.filename)
+	}
+	return logger.open()
+}
+
+func (entry Entry) String() string {
+	edns := "-"
+	if entry.Edns {
+		edns = fmt.Sprintf("E%d", entry.BufferSize)
+		if entry.Dnssec {
+			edns += "D"
+		}
+	}
+	return fmt.Sprintf("%s %s %s %s %d %s %s %d %d %s %.3f", entry.Time, entry.Client,
+		entry.Transport, entry.Qname, entry.Qclass, entry.Qtype, entry.Rcode,
+		entry.Answers, entry.Size, edns, entry.Latency)
+}
+
+// Formats the time (in nanoseconds since the epoch) for Entry.Time
+func FormatTime(nanoseconds int64) string {
+	t := time.SecondsToUTC(nanoseconds / 1e9)
+	return fmt.Sprintf("%s.%03dZ", t.Format("2006-01-02T15:04:05"), (nanoseconds%1e9)/1e6)
+}
+
+func (logger *Logger) Log(entry Entry) {
+	var line string
+	if logger.json {
+		data, error := json.Marshal(entry)
+		if error != nil {
+			return
+		}
+		line = string(data)
+	} else {
+		line = entry.String()
+	}
+	if logger.syslog != nil {
+		logger.syslog.Logf("%s", line)
+		return
+	}
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	if logger.file == nil { // A previous rotation failed
+		return
+	}
+	if logger.maxSize > 0 && logger.size+int64(len(line))+1 > logger.maxSize && logger.size > 0 {
+		error := logger.rotate()
+		if error != nil {
+			fmt.Fprintf(os.Stderr, "Cannot rotate the query log, stopping it: %s\n", error)
+			logger.file = nil
+			return
+		}
+	}
+	n, _ := logger.file.WriteString(line + "\n")
+	logger.size += int64(n)
+}
@@ -9,20 +9,50 @@ amiopen.openresolvers.org.
 
 Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
 
+ Example of use:
+
+ grong -servername "ns1.example.net" -- -qnames whoami.example.net,whoami6.example.net -port -details
+
+With -details, the TXT answer has extra records describing the query,
+like the ones of whoami.akamai.net or rs.dns-oarc.net:
+"transport=udp", "edns=4096" (or "edns=none"), "nsid=yes", "ecs=no",
+"flags=rd do".
+
+With -porttest, it also tests the randomness of the source ports and
+query IDs of the resolver, like porttest.dns-oarc.net: a query for the
+given name gets a CNAME to a unique name, which gets a CNAME to another
+one, and so on, and the last one gets a TXT verdict (GREAT, GOOD or
+POOR) computed from the standard deviation of the ports and IDs seen:
+
+ grong -servername "ns1.example.net" -- -porttest porttest.example.net
+
+ dig porttest.example.net TXT
+
 */
 
 package responder
 
 import (
+	"crypto/rand"
+	"fmt"
+	"math"
 	"net"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 	"./types"
+	"./myflag"
 )
 
-// Compile-time options
-const includesPort = false // If false, sends only the address for TXT queries.
-// If true, includes the UDP or TCP port.
-// TODO: allow to secify the Qname it must respond to
+var (
+	includesPort = false // If false, sends only the address for TXT queries.
+	// If true, includes the UDP or TCP port.
+	details = false         // Adds TXT records describing the query
+	qnames  map[string]bool // If not nil, the only names we respond to
+)
 
 func txtRecord(client net.Addr) []byte {
 	sclient := client.String()
@@ -42,6 +72,56 @@ func txtSection(qname string, client net.Addr) (result types.RR) {
 	return
 }
 
+func yesno(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// The texts describing the query, for the -details option
+func describe(query types.DNSquery) []string {
+	edns := "none"
+	if query.Edns {
+		edns = fmt.Sprintf("%d", query.BufferSize)
+	}
+	flags := make([]string, 0, 4)
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{{query.Flags&types.FLAGRD != 0, "rd"}, {query.Flags&types.FLAGAD != 0, "ad"},
+		{query.Flags&types.FLAGCD != 0, "cd"}, {query.Dnssec, "do"}} {
+		if flag.set {
+			flags = flags[0 : len(flags)+1]
+			flags[len(flags)-1] = flag.name
+		}
+	}
+	return []string{
+		"transport=" + query.Client.Network(),
+		"edns=" + edns,
+		"nsid=" + yesno(query.Nsid),
+		"ecs=" + yesno(query.Ecs),
+		"flags=" + strings.Join(flags, " "),
+	}
+}
+
+func detailsSection(query types.DNSquery) (result []types.RR) {
+	texts := describe(query)
+	result = make([]types.RR, len(texts))
+	for i, text := range texts {
+		result[i] = types.RR{Name: query.Qname, Type: types.TXT, Class: types.IN,
+			TTL: 0, Data: types.ToTXT(text)}
+	}
+	return
+}
+
+func concat(section []types.RR, rrs []types.RR) []types.RR {
+	result := make([]types.RR, len(section)+len(rrs))
+	copy(result, section)
+	copy(result[len(section):], rrs)
+	return result
+}
+
 func addressSection(qname string, client net.IP) (result types.RR) {
 	result.Name = qname
 	result.Type = types.A
@@ -60,11 +140,173 @@ func aaaaSection(qname string, client net.IP) (result types.RR) {
 	return
 }
 
+// A test of the ports and IDs of one resolver, identified by the
+// unique label of its CNAME chain
+type portTest struct {
+	start int64
+	ports []float64
+	ids   []float64
+}
+
+const (
+	maxPortTests   = 10000 // Simultaneous tests, to bound memory
+	portTestExpiry = 60    // Seconds
+	// Standard deviations, the same as porttest.dns-oarc.net
+	greatDeviation = 3980
+	goodDeviation  = 296
+)
+
+var (
+	porttestDomain = "" // If empty, no port test
+	chainLength    = 10
+	portTests      = make(map[string]*portTest)
+	portTestsMutex sync.Mutex
+)
+
+func deviation(values []float64) float64 {
+	var sum, squares float64
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+	return math.Sqrt(squares / float64(len(values)))
+}
+
+func verdict(deviation float64) string {
+	switch {
+	case deviation >= greatDeviation:
+		return "GREAT"
+	case deviation >= goodDeviation:
+		return "GOOD"
+	}
+	return "POOR"
+}
+
+func newLabel() string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("%x", random)
+}
+
+func cnameRecord(qname string, target string) types.RR {
+	return types.RR{Name: qname, Type: types.CNAME, Class: types.IN, TTL: 0,
+		Data: types.Encode(target)}
+}
+
+// Records the port and ID of the query in the test and returns it,
+// with the position in the chain. Must be called with the mutex held.
+func record(query types.DNSquery, label string, position int) (test *portTest) {
+	now := time.Seconds()
+	test, exists := portTests[label]
+	if !exists {
+		if position != 0 {
+			return nil // Expired or invented
+		}
+		if len(portTests) >= maxPortTests {
+			for label, old := range portTests {
+				if old.start+portTestExpiry < now {
+					portTests[label] = nil, false
+				}
+			}
+			if len(portTests) >= maxPortTests {
+				return nil
+			}
+		}
+		test = &portTest{start: now, ports: make([]float64, 0, chainLength+1),
+			ids: make([]float64, 0, chainLength+1)}
+		portTests[label] = test
+	}
+	if len(test.ports) != position {
+		return nil // Out of order
+	}
+	tcpAddr, _ := net.ResolveTCPAddr(query.Client.String())
+	test.ports = test.ports[0 : position+1]
+	test.ports[position] = float64(tcpAddr.Port)
+	test.ids = test.ids[0 : position+1]
+	test.ids[position] = float64(query.Id)
+	return test
+}
+
+// The porttest-style mode. The names in the chain are
+// label.position.domain.
+func porttestRespond(query types.DNSquery) (result types.DNSresponse) {
+	result.Responsecode = types.NOERROR
+	result.Authoritative = true
+	label := newLabel()
+	position := 0
+	if query.Qname != porttestDomain {
+		labels := strings.Split(query.Qname[0:len(query.Qname)-len(porttestDomain)-1], ".", -1)
+		var error os.Error
+		if len(labels) == 1 {
+			// position.domain is an empty non-terminal: it exists
+			// (NODATA, not NXDOMAIN), otherwise the resolvers which
+			// minimise the QNAME (RFC 9156) stop there
+			position, error = strconv.Atoi(labels[0])
+			if error != nil || position < 1 || position > chainLength {
+				result.Responsecode = types.NXDOMAIN
+			}
+			return
+		}
+		if len(labels) == 2 {
+			label = labels[0]
+			position, error = strconv.Atoi(labels[1])
+		}
+		if len(labels) != 2 || error != nil || position < 1 || position > chainLength {
+			result.Responsecode = types.NXDOMAIN
+			return
+		}
+	}
+	portTestsMutex.Lock()
+	defer portTestsMutex.Unlock()
+	test := record(query, label, position)
+	if test == nil {
+		result.Responsecode = types.NXDOMAIN
+		return
+	}
+	if position < chainLength {
+		target := fmt.Sprintf("%s.%d.%s", label, position+1, porttestDomain)
+		if !types.ValidName(target) { // One more digit may make it too long
+			result.Responsecode = types.NXDOMAIN
+			return
+		}
+		result.Ansection = []types.RR{cnameRecord(query.Qname, target)}
+		return
+	}
+	portTests[label] = nil, false
+	if query.Qtype != types.TXT && query.Qtype != types.ALL {
+		return
+	}
+	tcpAddr, _ := net.ResolveTCPAddr(query.Client.String())
+	portDeviation := deviation(test.ports)
+	idDeviation := deviation(test.ids)
+	// The overall verdict is the worst of the two
+	overall := verdict(math.Fmin(portDeviation, idDeviation))
+	texts := []string{
+		fmt.Sprintf("%s is %s: %d queries in %d seconds", tcpAddr.IP, overall,
+			len(test.ports), time.Seconds()-test.start),
+		fmt.Sprintf("ports are %s: std dev %.0f", verdict(portDeviation), portDeviation),
+		fmt.Sprintf("IDs are %s: std dev %.0f", verdict(idDeviation), idDeviation),
+	}
+	result.Ansection = make([]types.RR, len(texts))
+	for i, text := range texts {
+		result.Ansection[i] = types.RR{Name: query.Qname, Type: types.TXT, Class: types.IN,
+			TTL: 0, Data: types.ToTXT(text)}
+	}
+	return
+}
+
 func Respond(query types.DNSquery, config map[string]interface{}) types.DNSresponse {
 	var (
 		result types.DNSresponse
 	)
 	result.Ansection = nil
+	if porttestDomain != "" && query.Qclass == types.IN &&
+		(query.Qname == porttestDomain || strings.HasSuffix(query.Qname, "."+porttestDomain)) {
+		return porttestRespond(query)
+	}
 	tcpAddr, _ := net.ResolveTCPAddr(query.Client.String())
 	ipaddressV4 := tcpAddr.IP.To4()
 	zonei, zoneset := config["zonename"]
@@ -77,6 +319,8 @@ func Respond(query types.DNSquery, config map[string]interface{}) types.DNSrespo
 		result.Responsecode = types.SERVFAIL
 	case zone != "" && query.Qname != zone:
 		result.Responsecode = types.SERVFAIL
+	case qnames != nil && !qnames[query.Qname]:
+		result.Responsecode = types.SERVFAIL
 	case query.Qtype == types.A:
 		result.Responsecode = types.NOERROR
 		if ipaddressV4 != nil {
@@ -100,6 +344,9 @@ func Respond(query types.DNSquery, config map[string]interface{}) types.DNSrespo
 		ancount := 1
 		result.Ansection = make([]types.RR, ancount)
 		result.Ansection[0] = txtSection(query.Qname, query.Client)
+		if details {
+			result.Ansection = concat(result.Ansection, detailsSection(query))
+		}
 	case query.Qtype == types.ALL:
 		result.Responsecode = types.NOERROR
 		ancount := 2
@@ -110,11 +357,60 @@ func Respond(query types.DNSquery, config map[string]interface{}) types.DNSrespo
 		} else {
 			result.Ansection[1] = addressSection(query.Qname, ipaddressV4)
 		}
+		if details {
+			result.Ansection = concat(result.Ansection, detailsSection(query))
+		}
 	default:
 		result.Responsecode = types.NOERROR
 	}
 	return result
 }
 
+// Nothing to reload. The responses depend on the client so they are
+// never cached.
+func Reload() {
+}
+
 func Init(firstoption int) {
+	flag.Reinit(firstoption)
+	helpptr := flag.Bool("help", false, "Displays usage instructions")
+	portptr := flag.Bool("port", false, "Include the source port of the client in the TXT answer")
+	qnamesptr := flag.String("qnames", "",
+		"Set the comma-separated list of the names we respond to (default: all)")
+	detailsptr := flag.Bool("details", false,
+		"Add TXT records describing the transport, EDNS and flags of the query")
+	porttestptr := flag.String("porttest", "",
+		"Set the name for the test of the randomness of the resolver's ports and IDs (default: no test)")
+	chainptr := flag.Int("chain", 10, "Set the length of the CNAME chain of the port test")
+	flag.Parse()
+	if *helpptr {
+		fmt.Printf("Usage of the reflector responder:\n")
+		flag.PrintDefaults()
+		os.Exit(0)
+	}
+	if *chainptr < 1 {
+		fmt.Fprintf(os.Stderr, "The CNAME chain must have at least one element\n")
+		os.Exit(1)
+	}
+	chainLength = *chainptr
+	porttestDomain = strings.ToLower(*porttestptr)
+	if len(porttestDomain) > 1 && porttestDomain[len(porttestDomain)-1] == '.' {
+		porttestDomain = porttestDomain[0 : len(porttestDomain)-1]
+	}
+	if !types.ValidName(porttestDomain) {
+		fmt.Fprintf(os.Stderr, "Invalid domain name %s for -porttest\n", porttestDomain)
+		os.Exit(1)
+	}
+	includesPort = *portptr
+	details = *detailsptr
+	if *qnamesptr != "" {
+		qnames = make(map[string]bool)
+		for _, name := range strings.Split(*qnamesptr, ",", -1) {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if len(name) > 1 && name[len(name)-1] == '.' {
+				name = name[0 : len(name)-1]
+			}
+			qnames[name] = true
+		}
+	}
 }
@@ -0,0 +1,191 @@
+/* Response Rate Limiting: limits the number of identical responses
+   sent to the same network, to make the server less useful as an
+   amplifier of reflection attacks (the attacker spoofs the source
+   address of the victim). Same principles as the RRL of BIND,
+   <http://www.redbarn.org/dns/ratelimits>.
+
+   Responses are grouped by the prefix of the client and by "class":
+   the name and type for positive answers, the zone (the owner of the
+   SOA) for negative answers, the delegation for referrals, and only
+   the prefix for errors. Each group has an account which is credited
+   every second with the rate and debited for every response. When it
+   is negative, the responses are dropped, except one out of "slip"
+   which is sent truncated, so legitimate clients can retry with TCP.
+
+   The accounts are in a fixed-size hash table, each group having
+   only a few possible slots, so the memory is bounded and finding a
+   slot for a new group is done in constant time. If all the slots
+   of a group are used by groups which are still active, the least
+   recently used one is taken, like BIND does: an attacker who floods
+   the table makes some groups start again with a full account, but
+   the responses of the others are not limited.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package rrl
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"./types"
+)
+
+// What to do with a response
+const (
+	Send = iota
+	Drop
+	Slip // Send it truncated, and empty
+)
+
+var ActionNames = []string{"send", "drop", "slip"}
+
+const (
+	sets = 1 << 15 // Must be a power of two
+	ways = 4       // Slots per set, so 131072 groups at most
+)
+
+type account struct {
+	key     string // "" if the slot is free
+	balance int
+	last    int64 // Second of the last update
+	slipped int   // Limited responses since the last slip
+}
+
+type Limiter struct {
+	Rate     int // Responses per second and per group
+	Window   int // In seconds, the maximum debt is Rate*Window
+	SlipRate int // 0: drop everything, 1: truncate everything, 2: one out of two...
+	LogOnly  bool
+	accounts []account
+	seed     uint32 // So the sets of the groups cannot be predicted
+	mutex    sync.Mutex
+}
+
+func New(rate int, window int, slip int, logOnly bool) *Limiter {
+	random := make([]byte, 4)
+	rand.Read(random)
+	return &Limiter{Rate: rate, Window: window, SlipRate: slip, LogOnly: logOnly,
+		accounts: make([]account, sets*ways), seed: binary.BigEndian.Uint32(random)}
+}
+
+// FNV-1a, starting from the seed
+func (limiter *Limiter) hash(key string) uint32 {
+	h := uint32(2166136261) ^ limiter.seed
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// The account of the group, in its set: the existing one, or else a
+// free slot or the least recently used one, whose group is forgotten
+func (limiter *Limiter) find(key string, now int64) *account {
+	set := limiter.accounts[(limiter.hash(key)&(sets-1))*ways:][0:ways]
+	oldest := &set[0]
+	for i := range set {
+		acc := &set[i]
+		if acc.key == key {
+			return acc
+		}
+		if acc.key == "" || acc.last < oldest.last {
+			oldest = acc
+		}
+	}
+	*oldest = account{key: key, balance: limiter.Rate, last: now}
+	return oldest
+}
+
+// The /24 (IPv4) or /56 (IPv6) of the client, the same as BIND
+func prefix(client net.Addr) string {
+	udpAddr, error := net.ResolveUDPAddr(client.String())
+	if error != nil {
+		return client.String()
+	}
+	ipv4 := udpAddr.IP.To4()
+	if ipv4 != nil {
+		return ipv4.Mask(net.IPv4Mask(255, 255, 255, 0)).String()
+	}
+	mask := make(net.IPMask, net.IPv6len)
+	for i := 0; i < 7; i++ {
+		mask[i] = 0xff
+	}
+	return udpAddr.IP.Mask(mask).String()
+}
+
+func ownerOf(section []types.RR, rrtype uint16) (string, bool) {
+	for _, rr := range section {
+		if rr.Type == rrtype {
+			return rr.Name, true
+		}
+	}
+	return "", false
+}
+
+// The class of the response, see the beginning of this file. The
+// query name is in lowercase, otherwise a client could change its
+// case (RFC 1035, section 7.2) to get a new group for every query.
+func class(response types.DNSpacket) string {
+	qname := strings.ToLower(response.Qsection[0].Qname)
+	switch response.Rcode {
+	case types.NOERROR:
+		if len(response.Ansection) > 0 {
+			return fmt.Sprintf("answer/%s/%d", qname, response.Qsection[0].Qtype)
+		}
+		zone, found := ownerOf(response.Nssection, types.SOA)
+		if found {
+			return "nodata/" + zone
+		}
+		cut, found := ownerOf(response.Nssection, types.NS)
+		if found {
+			return "referral/" + cut
+		}
+		return "nodata/" + qname
+	case types.NXDOMAIN:
+		zone, found := ownerOf(response.Nssection, types.SOA)
+		if found {
+			return "nxdomain/" + zone
+		}
+		return "nxdomain/" + qname
+	}
+	return "error"
+}
+
+// Decides what to do with a response to this client. first is true
+// for the first response limited after a period without limitation,
+// which is the one to log. In LogOnly mode, the action is what would
+// have been done, the caller is in charge of sending anyway.
+func (limiter *Limiter) Check(client net.Addr, response types.DNSpacket) (action int, key string, first bool) {
+	key = prefix(client) + "/" + class(response)
+	now := time.Seconds()
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	acc := limiter.find(key, now)
+	if now > acc.last {
+		acc.balance += int(now-acc.last) * limiter.Rate
+		if acc.balance > limiter.Rate {
+			acc.balance = limiter.Rate
+		}
+		acc.last = now
+	}
+	if acc.balance > -limiter.Rate*limiter.Window {
+		acc.balance--
+	}
+	if acc.balance >= 0 {
+		acc.slipped = 0
+		return Send, key, false
+	}
+	first = acc.balance == -1
+	acc.slipped++
+	if limiter.SlipRate > 0 && acc.slipped >= limiter.SlipRate {
+		acc.slipped = 0
+		return Slip, key, first
+	}
+	return Drop, key, first
+}
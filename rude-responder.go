@@ -9,8 +9,12 @@ func Respond(query types.DNSquery, config map[string]interface{}) types.DNSrespo
 		result types.DNSresponse
 	)
 	result.Responsecode = types.REFUSED
+	result.Cacheable = true
 	return result
 }
 
 func Init(firstoption int) {
 }
+
+func Reload() {
+}
@@ -6,20 +6,95 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/binary"
 	"./myflag"
 	"fmt"
+	"http"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"os/signal"
+	prng "rand"
 	"strings"
 	"reflect"
 	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"syslog"
+	"time"
+	"./acl"
+	"./cache"
+	gdaemon "./daemon"
+	"./dnstap"
+	"./metrics"
+	"./prefix"
+	"./proxyproto"
+	"./querylog"
 	"./responder"
+	"./rrl"
+	"./tsig"
 	"./types"
+	"./view"
 )
 
 const defaultTTL = 3600
+
+const soReusePort = 15 // Linux value, not (yet?) in package syscall
+
+// The EDNS payload size we advertise, the one recommended by the DNS
+// Flag Day 2020 to avoid fragmentation. It is also the size of the
+// buffers for the UDP queries, since a client may use it.
+const ednsPayloadSize = 1232
+
+// Metrics, served if the -metrics option is set
+var (
+	queriesMetric = metrics.NewCounter("grong_queries_total",
+		"DNS queries answered", "transport", "qtype", "rcode", "opcode")
+	parseFailures = metrics.NewCounter("grong_parse_failures_total",
+		"Invalid packets, by the part where the error was found", "reason")
+	tcpConnections = metrics.NewCounter("grong_tcp_connections_total",
+		"TCP connections accepted (plain or TLS)", "transport")
+	aclMetric = metrics.NewCounter("grong_acl_denied_total",
+		"Queries denied by an ACL", "acl", "action")
+	rrlMetric = metrics.NewCounter("grong_rrl_responses_total",
+		"Responses limited by RRL (even in log-only mode)", "action")
+	responseSizes = metrics.NewHistogram("grong_response_size_bytes",
+		"Size of the responses", []float64{64, 128, 256, 512, 1024, 1232, 1500, 4096, 16384})
+	latencies = metrics.NewHistogram("grong_handling_seconds",
+		"Time to handle a query, from reception to sending",
+		[]float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.1, 1})
+)
+
+// The label of the opcode (4 bits) in queriesMetric, without a
+// fmt.Sprintf per query
+var opcodeLabels = [16]string{"0", "1", "2", "3", "4", "5", "6", "7",
+	"8", "9", "10", "11", "12", "13", "14", "15"}
+
+// Updates the metrics and the query log for a query. start is from
+// time.Nanoseconds().
+func account(response types.DNSpacket, client net.Addr, transport string, size int, start int64) {
+	now := time.Nanoseconds()
+	queriesMetric.Inc(transport, types.TypeName(response.Qsection[0].Qtype),
+		types.RcodeName(response.Rcode), opcodeLabels[response.Opcode&0x0F])
+	responseSizes.Observe(float64(size))
+	latencies.Observe(float64(now-start) / 1e9)
+	if queryLogger != nil {
+		queryLogger.Log(querylog.Entry{Time: querylog.FormatTime(start),
+			Client: client.String(), Transport: transport,
+			Qname: response.Qsection[0].Qname, Qtype: types.TypeName(response.Qsection[0].Qtype),
+			Qclass: response.Qsection[0].Qclass, Rcode: types.RcodeName(response.Rcode),
+			Answers: len(response.Ansection), Size: size,
+			Edns: response.Edns, BufferSize: response.EdnsBufferSize, Dnssec: response.Dnssec,
+			Latency: float64(now-start) / 1e6})
+	}
+}
+
 const loggerOptions = log.Ldate | log.Ltime | log.Lshortfile
 
 var (
@@ -32,6 +107,29 @@ var (
 	daemon                                bool
 	debuglogger, infologger, crisislogger *log.Logger
 	zone                                  string
+	tsigKeys                              map[string]*tsig.Key
+	limiter                               *rrl.Limiter     // nil if no rate limiting
+	responseCache                         *cache.Cache     // nil if no cache
+	tap                                   *dnstap.Writer   // nil if no dnstap
+	queryLogger                           *querylog.Logger // nil if no query log
+	idleTimeout                           int64            // In nanoseconds
+	accessRules                           *acl.Rules       // nil if no ACL, replaced on SIGHUP under reloadMutex
+	aclFile                               string
+	views                                 []*view.View // nil if no views, replaced on SIGHUP under reloadMutex
+	viewsFile                             string
+	proxyTransports                       map[string]bool // The listeners which accept the PROXY protocol
+	proxyTrusted                          []prefix.Prefix
+	proxyListeners                        []*proxyproto.Listener
+	reloadMutex                           sync.RWMutex
+	wildcardLocal                         string // The listener which gets the wildcard as local address, if any
+)
+
+// DNS over TLS (RFC 7858). The configuration is replaced on SIGHUP,
+// new connections use the new certificate.
+var (
+	tlsConfig              *tls.Config // nil if no DNS over TLS
+	tlsMutex               sync.Mutex  // Protects tlsConfig
+	tlsCertificate, tlsKey string      // File names
 )
 
 func fatal(msg string) {
@@ -48,112 +146,258 @@ func checkError(msg string, error os.Error) {
 	}
 }
 
-func serialize(packet types.DNSpacket) []byte {
-	// TODO: rewrite result as an io.Writer so we can just use Write? See
-	// the example in "Effective Go", section "Pointers vs Values"
-	result := make([]byte, packet.EdnsBufferSize)
+// Writes a resource record in result, starting at last. Returns the
+// new end, or false if there is not enough room. A record with an
+// invalid owner name (a bug of the responder) is handled like one
+// which does not fit, so the response is truncated, not corrupted.
+func serializeRR(result []byte, last int, rr types.RR) (int, bool) {
+	if last+types.RRLength(rr) > len(result) {
+		return last, false
+	}
+	written, ok := types.AppendRR(result[0:last], rr)
+	if !ok {
+		debuglogger.Logf("Invalid name \"%s\" in a response\n", rr.Name)
+		return last, false
+	}
+	return len(written), true
+}
+
+// Returns the end of the RRset which begins at start, including the
+// RRSIG records which follow it and cover it
+func rrsetEnd(rrs []types.RR, start int) int {
+	end := start + 1
+	for end < len(rrs) && rrs[end].Name == rrs[start].Name &&
+		rrs[end].Type == rrs[start].Type && rrs[end].Type != types.RRSIG {
+		end++
+	}
+	for end < len(rrs) && rrs[end].Name == rrs[start].Name &&
+		rrs[end].Type == types.RRSIG && len(rrs[end].Data) >= 2 &&
+		binary.BigEndian.Uint16(rrs[end].Data[0:2]) == rrs[start].Type {
+		end++
+	}
+	return end
+}
+
+// maxsize is the largest response the client accepts (EDNS buffer size
+// for UDP, 65535 for TCP). If the answer or authority sections do not
+// fit, the response is truncated and the TC bit set. The response is
+// written in buffer, if it is large enough, so the caller can reuse
+// it; otherwise (for instance if buffer is nil), a new one is
+// allocated.
+func serialize(packet types.DNSpacket, maxsize int, buffer []byte) []byte {
+	result := buffer
+	if cap(result) < maxsize {
+		result = make([]byte, maxsize)
+	}
+	result = result[0:maxsize]
+	if packet.Wire != nil && len(packet.Wire) <= maxsize && !packet.Truncated {
+		return patchCached(packet, result)
+	}
 	// ID
 	binary.BigEndian.PutUint16(result[0:2], packet.Id)
 	// Misc flags...
 	result[2] = 0x80 // QR 1 (response), everything else 0
+	if packet.Authoritative {
+		result[2] |= 0x04
+	}
 	result[3] = byte(packet.Rcode)
 	binary.BigEndian.PutUint16(result[4:6], packet.Qdcount)
-	// Ancount
-	binary.BigEndian.PutUint16(result[6:8], packet.Ancount)
-	// Nscount
-	result[8] = 0
-	result[9] = 0
-	// Arcount
-	result[10] = 0
-	if packet.Edns {
-		result[11] = 1
-	} else {
-		result[11] = 0
-	}
 	if len(packet.Qsection) != 1 {
 		fatal(fmt.Sprintf("Qsection's length is not 1: %d\n", len(packet.Qsection)))
 	}
-	encoded_qname := types.Encode(packet.Qsection[0].Qname)
-	n := copy(result[12:], encoded_qname)
-	if n != len(encoded_qname) {
-		fatal(fmt.Sprintf("Copying %d bytes from a name of %d bytes\n",
-			n, len(encoded_qname)))
+	qnamelength := types.NameLength(packet.Qsection[0].Qname)
+	if 12+qnamelength+4 > maxsize {
+		fatal(fmt.Sprintf("Name of %d bytes too long for a response of %d bytes\n",
+			qnamelength, maxsize))
+	}
+	_, ok := types.AppendName(result[0:12], packet.Qsection[0].Qname)
+	if !ok { // parse refuses these names, but never send what the buffer had before
+		return formatError(packet.Id, result)
 	}
-	last := 12 + len(encoded_qname)
+	last := 12 + qnamelength
 	binary.BigEndian.PutUint16(result[last:], packet.Qsection[0].Qtype)
 	binary.BigEndian.PutUint16(result[last+2:], packet.Qsection[0].Qclass)
 	last = last + 4
-	for rrnum, rr := range packet.Ansection {
-		encoded_qname := types.Encode(packet.Ansection[rrnum].Name)
-		n = copy(result[last:], encoded_qname)
-		if n != len(encoded_qname) {
-			fatal(fmt.Sprintf("Copying %d bytes from a name of %d bytes\n",
-				n, len(encoded_qname)))
-		}
-		last = last + len(encoded_qname)
-		binary.BigEndian.PutUint16(result[last:last+2], rr.Type)
-		binary.BigEndian.PutUint16(result[last+2:last+4], rr.Class)
-		binary.BigEndian.PutUint32(result[last+4:last+8], rr.TTL)
-		binary.BigEndian.PutUint16(result[last+8:last+10], uint16(len(rr.Data)))
-		last = last + 10
-		n = copy(result[last:], packet.Ansection[rrnum].Data)
-		if n != len(packet.Ansection[rrnum].Data) {
-			fatal(fmt.Sprintf("Copying %d bytes from data of %d bytes\n",
-				n, len(packet.Ansection[rrnum].Data)))
-		}
-		last = last + len(packet.Ansection[rrnum].Data)
+	// Keep room for the OPT record
+	var options []byte
+	optsize := 0
+	if packet.Edns {
+		servernamei, nameexists := globalConfig["servername"]
+		if nameexists && packet.Nsid {
+			servername := reflect.NewValue(servernamei).(*reflect.StringValue).Get()
+			options = appendOption(options, types.NSID, []byte(servername))
+		}
+		if packet.EcsReply {
+			// RFC 7871, section 7.2.1: the query's option, with the scope
+			ecs := make([]byte, 4+(int(packet.EcsSource)+7)/8)
+			binary.BigEndian.PutUint16(ecs[0:2], packet.EcsFamily)
+			ecs[2] = packet.EcsSource
+			ecs[3] = packet.EcsScope
+			address := packet.EcsAddress
+			if packet.EcsFamily == 1 {
+				address = address.To4()
+			}
+			copy(ecs[4:], address)
+			options = appendOption(options, types.CLIENTSUBNET, ecs)
+		}
+		optsize = 11 + len(options)
+	}
+	// And for the TSIG record, which must be there even when the
+	// response is truncated (RFC 8945, section 5.3)
+	tsigsize := 0
+	if packet.Tsig != nil {
+		tsigsize = tsig.Length(packet.Tsig, packet.TsigError, tsigKeys[packet.Tsig.Name])
+	}
+	room := maxsize - optsize - tsigsize
+	if room < last {
+		room = last
 	}
+	limit := result[0:room]
+	truncated := packet.Truncated
+	omitted := false // Additional data left out for lack of room
+	counts := make([]uint16, 3)
+	for section, rrs := range [][]types.RR{packet.Ansection, packet.Nssection, packet.Arsection} {
+		for start := 0; start < len(rrs) && !truncated; {
+			// An RRset, and its signatures, is never split, RFC
+			// 2181, section 9
+			end := rrsetEnd(rrs, start)
+			newlast, ok := last, true
+			for i := start; i < end && ok; i++ {
+				newlast, ok = serializeRR(limit, newlast, rrs[i])
+			}
+			if !ok {
+				// Omitting additional data is not a truncation, RFC
+				// 2181, section 9
+				truncated = section < 2
+				omitted = section == 2
+				break
+			}
+			last = newlast
+			counts[section] += uint16(end - start)
+			start = end
+		}
+	}
+	if truncated {
+		result[2] |= 0x02
+	}
+	binary.BigEndian.PutUint16(result[6:8], counts[0])  // Ancount
+	binary.BigEndian.PutUint16(result[8:10], counts[1]) // Nscount
+	if packet.Edns {
+		counts[2]++
+	}
+	binary.BigEndian.PutUint16(result[10:12], counts[2]) // Arcount
 	if packet.Edns {
 		result[last] = 0 // EDNS0's Name
 		binary.BigEndian.PutUint16(result[last+1:last+3], types.OPT)
-		binary.BigEndian.PutUint16(result[last+3:last+5], packet.EdnsBufferSize)
+		binary.BigEndian.PutUint16(result[last+3:last+5], ednsPayloadSize) // Ours, RFC 6891, section 6.2.3
 		binary.BigEndian.PutUint32(result[last+5:last+9], 0)
-		servernamei, nameexists := globalConfig["servername"]
-		if nameexists {
-			servername := reflect.NewValue(servernamei).(*reflect.StringValue).Get()
-			if packet.Nsid {
-				binary.BigEndian.PutUint16(result[last+9:last+11],
-					uint16(4+len(servername)))
-				binary.BigEndian.PutUint16(result[last+11:last+13], types.NSID)
-				binary.BigEndian.PutUint16(result[last+13:last+15], uint16(len(servername)))
-				last += 15
-				n = copy(result[last:], []byte(servername))
-				if n != len(servername) {
-					fatal(fmt.Sprintf("Cannot copy servername (length %d bytes), %d bytes actually copied\n", len(servername), n))
-				}
-				last += int(len(servername))
-			} else {
-				// Zero EDNS options
-				binary.BigEndian.PutUint16(result[last+9:last+11], 0)
-				last += 11
-			}
+		if packet.Dnssec {
+			result[last+7] = 0x80 // The DO bit, RFC 3225, section 3
 		}
+		binary.BigEndian.PutUint16(result[last+9:last+11], uint16(len(options)))
+		last += 11
+		last += copy(result[last:], options)
+	}
+	if packet.Tsig != nil {
+		// The TSIG record must be the last one
+		return tsig.Sign(result[0:last], packet.Tsig, packet.TsigError, tsigKeys[packet.Tsig.Name])
+	}
+	// The cache key does not include the size of the client's buffer,
+	// so a response which depends on it is not cached: a client with
+	// a larger buffer would get it without the additional data
+	if packet.CacheKey != "" && !truncated && !omitted {
+		wire := make([]byte, last)
+		copy(wire, result[0:last])
+		responseCache.Add(packet.CacheKey, cachedResponse(packet), wire)
 	}
 	return result[0:last]
 }
 
+// Adds an EDNS option (RFC 6891, section 6.1.2)
+func appendOption(options []byte, code uint16, data []byte) []byte {
+	result := make([]byte, len(options)+4+len(data))
+	copy(result, options)
+	binary.BigEndian.PutUint16(result[len(options):], code)
+	binary.BigEndian.PutUint16(result[len(options)+2:], uint16(len(data)))
+	copy(result[len(options)+4:], data)
+	return result
+}
+
+// Copies the response from the cache in result and patches what is
+// specific to this query: the ID, the case of the query name (RFC
+// 1035, section 7.2, clients may check it).
+func patchCached(packet types.DNSpacket, result []byte) []byte {
+	copy(result, packet.Wire)
+	binary.BigEndian.PutUint16(result[0:2], packet.Id)
+	_, ok := types.AppendName(result[0:12], packet.Qsection[0].Qname)
+	if !ok {
+		return formatError(packet.Id, result)
+	}
+	return result[0:len(packet.Wire)]
+}
+
+// A FORMERR response with only the header, when the query name cannot
+// be copied in the response
+func formatError(id uint16, result []byte) []byte {
+	debuglogger.Logf("Invalid query name, answering FORMERR\n")
+	binary.BigEndian.PutUint16(result[0:2], id)
+	result[2] = 0x80 // QR
+	result[3] = types.FORMERR
+	for i := 4; i < 12; i++ { // No question, no records
+		result[i] = 0
+	}
+	return result[0:12]
+}
+
+// The part of the response which is stored with the serialized one,
+// for the users of the response (such as the rate limiting) other
+// than serialize
+func cachedResponse(packet types.DNSpacket) (response types.DNSresponse) {
+	response.Responsecode = packet.Rcode
+	response.Authoritative = packet.Authoritative
+	response.Ansection = packet.Ansection
+	response.Nssection = packet.Nssection
+	response.Arsection = packet.Arsection
+	response.Cacheable = true
+	return
+}
+
+// Everything which may change the serialized response, except what
+// patchCached patches
+func cacheKey(query types.DNSquery) string {
+	return fmt.Sprintf("%s/%d/%d/%t/%t/%t/%s", query.Qname, query.Qtype, query.Qclass,
+		query.Dnssec, query.Edns, query.Nsid, query.View)
+}
+
+// The read* functions do not allocate: they use Next, which returns a
+// slice of the buffer. So, what they return is only valid while the
+// message is handled.
 func readShortInteger(buf *bytes.Buffer) (uint16, bool) {
-	slice := make([]byte, 2)
-	n, error := buf.Read(slice[0:2])
-	if error != nil || n != 2 {
+	slice := buf.Next(2)
+	if len(slice) != 2 {
 		if debug > 2 {
-			debuglogger.Logf("Error in Read of an int16: %s (%d bytes read)\n", error, n)
+			debuglogger.Logf("Error in Read of an int16: %d bytes read\n", len(slice))
 		}
 		return 0, false
 	}
-	return binary.BigEndian.Uint16(slice[0:2]), true
+	return binary.BigEndian.Uint16(slice), true
 }
 
 func readInteger(buf *bytes.Buffer) (uint32, bool) {
-	slice := make([]byte, 4)
-	n, error := buf.Read(slice[0:4])
-	if error != nil || n != 4 {
+	slice := buf.Next(4)
+	if len(slice) != 4 {
 		if debug > 2 {
-			debuglogger.Logf("Error in Read of an int32: %s (%d bytes read)\n", error, n)
+			debuglogger.Logf("Error in Read of an int32: %d bytes read\n", len(slice))
 		}
 		return 0, false
 	}
-	return binary.BigEndian.Uint32(slice[0:4]), true
+	return binary.BigEndian.Uint32(slice), true
+}
+
+// Counts the invalid packets, by reason, and returns false
+func parseFailure(reason string) bool {
+	parseFailures.Inc(reason)
+	return false
 }
 
 func parse(buf *bytes.Buffer) (types.DNSpacket, bool) {
@@ -161,6 +405,7 @@ func parse(buf *bytes.Buffer) (types.DNSpacket, bool) {
 		packet types.DNSpacket
 		ok     bool
 	)
+	message := buf.Bytes() // Unread part, which is the whole message, for the offsets
 	// Initialize with sensible values
 	packet.Edns = false
 	packet.EdnsBufferSize = 512
@@ -168,12 +413,13 @@ func parse(buf *bytes.Buffer) (types.DNSpacket, bool) {
 
 	packet.Id, ok = readShortInteger(buf)
 	if !ok {
-		return packet, false
+		return packet, parseFailure("header")
 	}
 	dnsmisc, ok := readShortInteger(buf)
 	if !ok {
-		return packet, false
+		return packet, parseFailure("header")
 	}
+	packet.Flags = dnsmisc
 	qr := (dnsmisc & 0x8000) >> 15
 	packet.Query = false
 	if qr == 0 {
@@ -188,174 +434,369 @@ func parse(buf *bytes.Buffer) (types.DNSpacket, bool) {
 	packet.Rcode = uint(dnsmisc & 0x000F)
 	packet.Qdcount, ok = readShortInteger(buf)
 	if !ok {
-		return packet, false
+		return packet, parseFailure("header")
 	}
 	if packet.Qdcount != 1 {
 		// This may be legal but we would not know what to do with it
-		return packet, false
+		return packet, parseFailure("qdcount")
 	}
 	packet.Ancount, ok = readShortInteger(buf)
 	if !ok {
-		return packet, false
+		return packet, parseFailure("header")
 	}
-	// TODO: reject packets with non-empty answer or authority sections
 	packet.Nscount, ok = readShortInteger(buf)
 	if !ok {
-		return packet, false
+		return packet, parseFailure("header")
 	}
 	packet.Arcount, ok = readShortInteger(buf)
 	if !ok {
-		return packet, false
+		return packet, parseFailure("header")
 	}
-	over := false
-	labels_max := make([]string, 63)
-	labels := labels_max[0:0]
 	// Parse the Question section
-	nlabels := 0
-	for !over {
-		labelsize, error := buf.ReadByte()
-		if error != nil {
-			if error == os.EOF {
-				return packet, false
-			} else {
-				if debug > 2 {
-					debuglogger.Logf("Error in ReadByte: %s\n", error)
-				}
-				return packet, false
-			}
-		}
-		if labelsize == 0 {
-			over = true
-			break
-		}
-		label := make([]byte, labelsize)
-		n, error := buf.Read(label)
-		if error != nil || n != int(labelsize) {
-			if error == nil {
-				// Client left after leaving only a few bytes
-				return packet, false
-			} else {
-				if debug > 2 {
-					debuglogger.Logf("Error in Read %d bytes: %s\n", n, error)
-				}
-				return packet, false
-			}
-		}
-		nlabels += 1
-		labels = labels[0:nlabels]
-		labels[nlabels-1] = string(label)
-	}
 	packet.Qsection = make([]types.Qentry, packet.Qdcount)
-	if len(labels) == 0 { // A special case, the root (see issue #4)
-		packet.Qsection[0].Qname = "."
-	} else {
-		packet.Qsection[0].Qname = strings.Join(labels, ".")
+	packet.Qsection[0].Qname, ok = readName(buf)
+	if !ok {
+		return packet, parseFailure("question")
 	}
 	packet.Qsection[0].Qtype, ok = readShortInteger(buf)
 	if !ok {
-		return packet, false
+		return packet, parseFailure("question")
 	}
 	packet.Qsection[0].Qclass, ok = readShortInteger(buf)
 	if !ok {
-		return packet, false
+		return packet, parseFailure("question")
 	}
-	if packet.Arcount > 0 {
-		labelsize, error := buf.ReadByte()
-		if error != nil {
-			if error == os.EOF {
-				return packet, false
-			} else {
-				if debug > 2 {
-					debuglogger.Logf("Error in ReadByte: %s\n", error)
-				}
-				return packet, false
-			}
+	// Skip the Answer and Authority sections, we have no use for them
+	for rrnum := 0; rrnum < int(packet.Ancount)+int(packet.Nscount); rrnum++ {
+		_, ok = readName(buf)
+		if !ok {
+			return packet, parseFailure("answer-authority")
 		}
-		if labelsize != 0 {
-			if debug > 2 {
-				debuglogger.Logf("Additional section with non-empty name\n")
-			}
-			return packet, false
+		_, ok = readShortInteger(buf)
+		if !ok {
+			return packet, parseFailure("answer-authority")
+		}
+		_, ok = readRR(buf)
+		if !ok {
+			return packet, parseFailure("answer-authority")
+		}
+	}
+	for arnum := uint16(0); arnum < packet.Arcount; arnum++ {
+		start := len(message) - buf.Len()
+		arname, ok := readName(buf)
+		if !ok {
+			return packet, parseFailure("additional")
 		}
 		artype, ok := readShortInteger(buf)
 		if !ok {
-			return packet, false
+			return packet, parseFailure("additional")
 		}
-		if artype == types.OPT {
-			packet.Edns = true
-			packet.EdnsBufferSize, ok = readShortInteger(buf)
+		switch artype {
+		case types.OPT:
+			if arname != "." {
+				if debug > 2 {
+					debuglogger.Logf("Additional section with non-empty name\n")
+				}
+				return packet, parseFailure("edns")
+			}
+			ok = parseEdns(buf, &packet)
 			if !ok {
-				return packet, false
+				return packet, parseFailure("edns")
 			}
-			extrcode, ok := readInteger(buf)
+		case types.TSIG:
+			if arnum != packet.Arcount-1 {
+				if debug > 2 {
+					debuglogger.Logf("TSIG record is not the last one\n")
+				}
+				return packet, parseFailure("tsig")
+			}
+			rdata, ok := readRR(buf)
 			if !ok {
-				return packet, false
+				return packet, parseFailure("tsig")
 			}
-			ednslength, ok := readShortInteger(buf)
+			packet.Tsig, ok = tsig.Parse(arname, rdata)
 			if !ok {
-				return packet, false
-			}
-			options := make([]byte, ednslength)
-			if ednslength > 0 {
-				n, error := buf.Read(options)
-				if error != nil || n != int(ednslength) {
-					if error == nil {
-						// Client left after leaving only a few bytes
-						return packet, false
-					} else {
-						if debug > 2 {
-							debuglogger.Logf("Error in Read %d bytes: %s\n", n, error)
-						}
-						return packet, false
-					}
-				}
-				over = false
-				counter := 0
-				for !over {
-					optcode := binary.BigEndian.Uint16(options[counter : counter+2])
-					if optcode == types.NSID {
-						packet.Nsid = true
-					}
-					optlen := int(binary.BigEndian.Uint16(options[counter+2 : counter+4]))
-					if optlen > 0 {
-						if counter+4+optlen > len(options) {
-							return packet, false
-						}
-						_ = options[counter+4 : counter+4+optlen] // Yes, useless, I know
-					}
-					counter += (4 + optlen)
-					if counter >= len(options) {
-						over = true
-					}
-					if debug > 3 {
-						debuglogger.Logf("EDNS option code %d\n", optcode)
-					}
-
+				if debug > 2 {
+					debuglogger.Logf("Invalid TSIG record\n")
 				}
+				return packet, parseFailure("tsig")
 			}
+			packet.Tsig.Start = start
+		default:
 			if debug > 2 {
-				debuglogger.Logf("EDNS0 found, buffer size is %d, extended rcode is %d, ", packet.EdnsBufferSize, extrcode)
-				if ednslength > 0 {
-					debuglogger.Logf("length of options is %d\n", ednslength)
-				} else {
-					debuglogger.Logf("no options\n")
-				}
+				debuglogger.Logf("Ignore additional section if not EDNS or TSIG\n")
 			}
-		} else {
-			if debug > 2 {
-				debuglogger.Logf("Ignore additional section if not EDNS")
+			_, ok := readRR(buf)
+			if !ok {
+				return packet, parseFailure("additional")
 			}
 		}
 	}
 	return packet, true
 }
 
-func generichandle(buf *bytes.Buffer, remaddr net.Addr) (response types.DNSpacket, noresponse bool) {
+// Reads a domain name. Compression is not supported.
+func readName(buf *bytes.Buffer) (string, bool) {
+	name, length, ok := types.Decode(buf.Bytes())
+	if !ok {
+		if debug > 2 {
+			debuglogger.Logf("Invalid or truncated name\n")
+		}
+		return "", false
+	}
+	buf.Next(length)
+	return name, true
+}
+
+// Reads the class, TTL and RDATA of a resource record (the name and
+// the type being already read) and returns the RDATA
+func readRR(buf *bytes.Buffer) ([]byte, bool) {
+	_, ok := readShortInteger(buf)
+	if !ok {
+		return nil, false
+	}
+	_, ok = readInteger(buf)
+	if !ok {
+		return nil, false
+	}
+	rdlength, ok := readShortInteger(buf)
+	if !ok {
+		return nil, false
+	}
+	rdata := buf.Next(int(rdlength))
+	if len(rdata) != int(rdlength) {
+		return nil, false
+	}
+	return rdata, true
+}
+
+// The EDNS Client Subnet option, RFC 7871, section 6. An invalid
+// option is ignored (EcsAddress stays nil).
+func parseEcs(data []byte, packet *types.DNSpacket) {
+	if len(data) < 4 {
+		return
+	}
+	family := binary.BigEndian.Uint16(data[0:2])
+	source := data[2]
+	size := 0
+	switch family {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		return
+	}
+	// The scope must be zero in queries and the address must not have
+	// more bytes than the source prefix length needs
+	if int(source) > 8*size || data[3] != 0 || len(data)-4 != (int(source)+7)/8 {
+		return
+	}
+	address := make(net.IP, size)
+	copy(address, data[4:])
+	packet.EcsFamily = family
+	packet.EcsSource = source
+	packet.EcsAddress = address
+}
+
+// Parses the OPT pseudo-record of EDNS (RFC 6891), the name and the
+// type being already read
+func parseEdns(buf *bytes.Buffer, packet *types.DNSpacket) bool {
+	var ok bool
+	packet.Edns = true
+	packet.EdnsBufferSize, ok = readShortInteger(buf)
+	if !ok {
+		return false
+	}
+	extrcode, ok := readInteger(buf)
+	if !ok {
+		return false
+	}
+	packet.Dnssec = extrcode&0x8000 != 0
+	ednslength, ok := readShortInteger(buf)
+	if !ok {
+		return false
+	}
+	options := buf.Next(int(ednslength))
+	if len(options) != int(ednslength) {
+		// Client left after leaving only a few bytes
+		return false
+	}
+	if ednslength > 0 {
+		over := false
+		counter := 0
+		for !over {
+			if counter+4 > len(options) {
+				return false
+			}
+			optcode := binary.BigEndian.Uint16(options[counter : counter+2])
+			optlen := int(binary.BigEndian.Uint16(options[counter+2 : counter+4]))
+			if counter+4+optlen > len(options) {
+				return false
+			}
+			switch optcode {
+			case types.NSID:
+				packet.Nsid = true
+			case types.CLIENTSUBNET:
+				packet.Ecs = true
+				parseEcs(options[counter+4:counter+4+optlen], packet)
+			}
+			counter += (4 + optlen)
+			if counter >= len(options) {
+				over = true
+			}
+			if debug > 3 {
+				debuglogger.Logf("EDNS option code %d\n", optcode)
+			}
+
+		}
+	}
+	if debug > 2 {
+		debuglogger.Logf("EDNS0 found, buffer size is %d, extended rcode is %d, ", packet.EdnsBufferSize, extrcode)
+		if ednslength > 0 {
+			debuglogger.Logf("length of options is %d\n", ednslength)
+		} else {
+			debuglogger.Logf("no options\n")
+		}
+	}
+	return true
+}
+
+// Order of the records within an RRset (-rrsetorder)
+const (
+	orderFixed = iota // As given by the responder
+	orderCyclic
+	orderRandom
+)
+
+var orderNames = map[string]int{"fixed": orderFixed, "cyclic": orderCyclic, "random": orderRandom}
+
+var (
+	rrsetOrder    int
+	zoneOrders    map[string]int // Overrides rrsetOrder in these zones
+	cyclicCounter uint
+	orderMutex    sync.Mutex // Protects cyclicCounter and prng
+)
+
+func nextCounter() uint {
+	orderMutex.Lock()
+	defer orderMutex.Unlock()
+	cyclicCounter++
+	return cyclicCounter
+}
+
+// The order in the most specific zone of name
+func orderOf(name string) int {
+	for {
+		order, exists := zoneOrders[name]
+		if exists {
+			return order
+		}
+		if name == "." {
+			return rrsetOrder
+		}
+		dot := strings.Index(name, ".")
+		if dot < 0 {
+			name = "."
+		} else {
+			name = name[dot+1:]
+		}
+	}
+	return rrsetOrder // Never reached
+}
+
+// Changes the order of the records of each RRset of the section: a
+// rotation by counter (cyclic) or a random shuffle. The section is
+// copied, since it may belong to the responder. changed is true if at
+// least one RRset can change order.
+func reorder(section []types.RR, counter uint) (result []types.RR, changed bool) {
+	result = section
+	for start := 0; start < len(section); {
+		end := start + 1
+		for end < len(section) && section[end].Name == section[start].Name &&
+			section[end].Type == section[start].Type && section[end].Class == section[start].Class {
+			end++
+		}
+		n := end - start
+		order := orderFixed
+		if n > 1 {
+			order = orderOf(strings.ToLower(section[start].Name))
+		}
+		if order != orderFixed {
+			if !changed {
+				result = make([]types.RR, len(section))
+				copy(result, section)
+				changed = true
+			}
+			rrset := result[start:end]
+			switch order {
+			case orderCyclic:
+				shift := int(counter % uint(n))
+				for i := range rrset {
+					rrset[i] = section[start+(i+shift)%n]
+				}
+			case orderRandom:
+				orderMutex.Lock()
+				for i := n - 1; i > 0; i-- {
+					j := prng.Intn(i + 1)
+					rrset[i], rrset[j] = rrset[j], rrset[i]
+				}
+				orderMutex.Unlock()
+			}
+		}
+		start = end
+	}
+	return
+}
+
+// The operation of a query, for the ACLs
+func operation(packet types.DNSpacket) string {
+	switch packet.Opcode {
+	case types.STDQUERY:
+		switch packet.Qsection[0].Qtype {
+		case types.AXFR:
+			return "axfr"
+		case types.IXFR:
+			return "ixfr"
+		}
+		return "query"
+	case types.NOTIFY:
+		return "notify"
+	case types.UPDATE:
+		return "update"
+	}
+	return ""
+}
+
+// The header and the question of the response to packet
+func newResponse(packet types.DNSpacket) (response types.DNSpacket) {
+	response.Id = packet.Id
+	response.Query = false
+	response.Opcode = packet.Opcode
+	response.Qdcount = 1 // Or packet.Qdcount ?
+	response.Qsection = make([]types.Qentry, response.Qdcount)
+	response.Qsection[0].Qname = packet.Qsection[0].Qname
+	response.Qsection[0].Qclass = packet.Qsection[0].Qclass
+	response.Qsection[0].Qtype = packet.Qsection[0].Qtype
+	response.Edns = packet.Edns
+	response.Nsid = packet.Nsid
+	response.Dnssec = packet.Dnssec
+	return response
+}
+
+// transport is the listener: udp, tcp, tls, https or http. local is
+// the address of the listener.
+func generichandle(buf *bytes.Buffer, remaddr net.Addr, local net.Addr, transport string) (response types.DNSpacket, noresponse bool) {
 	var (
 		query           types.DNSquery
 		desiredresponse types.DNSresponse
 	)
 	noresponse = true
+	reloadMutex.RLock()
+	rules := accessRules
+	currentViews := views
+	reloadMutex.RUnlock()
+	message := buf.Bytes() // Before parse() consumes it, for TSIG
 	packet, valid := parse(buf)
 	if !valid { // Invalid packet or client too impatient
 		if debug > 3 {
@@ -366,32 +807,85 @@ func generichandle(buf *bytes.Buffer, remaddr net.Addr) (response types.DNSpacke
 	if debug > 2 {
 		debuglogger.Logf("%s\n", packet)
 	}
+	if packet.Query && rules != nil {
+		allowed, denier := rules.Check(prefix.Address(remaddr), transport,
+			strings.ToLower(packet.Qsection[0].Qname), operation(packet))
+		if !allowed {
+			action := "refused"
+			if rules.Drop {
+				action = "drop"
+			}
+			aclMetric.Inc(denier, action)
+			if debug > 1 {
+				debuglogger.Logf("Query from %s denied by ACL %s\n", remaddr, denier)
+			}
+			if rules.Drop {
+				return
+			}
+			noresponse = false
+			response = newResponse(packet)
+			response.EdnsBufferSize = 512
+			response.Rcode = types.REFUSED
+			return
+		}
+	}
 	if packet.Query && packet.Opcode == types.STDQUERY {
 		if debug > 2 {
 			debuglogger.Logf("Replying with ID %d...\n", packet.Id)
 		}
 		noresponse = false
-		response.Id = packet.Id
-		response.Query = false
-		response.Opcode = packet.Opcode
-		response.Qdcount = 1 // Or packet.Qdcount ?
-		response.Qsection = make([]types.Qentry, response.Qdcount)
-		response.Qsection[0].Qname = packet.Qsection[0].Qname
-		response.Qsection[0].Qclass = packet.Qsection[0].Qclass
-		response.Qsection[0].Qtype = packet.Qsection[0].Qtype
-		response.Edns = packet.Edns
-		response.Nsid = packet.Nsid
+		response = newResponse(packet)
 		query.Client = remaddr
+		query.Dnssec = packet.Dnssec
+		query.Id = packet.Id
+		query.Flags = packet.Flags
+		query.Edns = packet.Edns
+		query.Nsid = packet.Nsid
+		query.Ecs = packet.Ecs
+		query.EcsAddress = packet.EcsAddress
+		query.EcsSource = packet.EcsSource
 		query.Qname = strings.ToLower(packet.Qsection[0].Qname)
 		query.Qclass = packet.Qsection[0].Qclass
 		query.Qtype = packet.Qsection[0].Qtype
 		if packet.Edns {
+			if packet.EdnsBufferSize < 512 { // RFC 6891, section 6.2.3
+				packet.EdnsBufferSize = 512
+			}
 			query.BufferSize = packet.EdnsBufferSize
 			response.EdnsBufferSize = packet.EdnsBufferSize
 		} else {
 			query.BufferSize = 512 // Traditional value
 			response.EdnsBufferSize = 512
 		}
+		keyname := "" // Of the TSIG key, if the query is signed
+		if packet.Tsig != nil {
+			key, tsigerror := tsig.Verify(message, packet.Tsig, tsigKeys)
+			response.Tsig = packet.Tsig
+			response.TsigError = tsigerror
+			if tsigerror != 0 {
+				if debug > 1 {
+					debuglogger.Logf("TSIG error %d for key %s from %s\n",
+						tsigerror, packet.Tsig.Name, remaddr)
+				}
+				response.Rcode = types.NOTAUTH
+				return
+			}
+			if debug > 2 {
+				debuglogger.Logf("Request signed with key %s\n", key.Name)
+			}
+			keyname = key.Name
+		}
+		if currentViews != nil {
+			var found bool
+			query.View, found = view.Select(currentViews, prefix.Address(remaddr), prefix.Address(local), keyname)
+			if !found {
+				if debug > 1 {
+					debuglogger.Logf("No view for the query from %s\n", remaddr)
+				}
+				response.Rcode = types.REFUSED
+				return
+			}
+		}
 		servernamei, nameexists := globalConfig["servername"]
 		if query.Qclass == types.CH && query.Qtype == types.TXT &&
 			(query.Qname == "hostname.bind" ||
@@ -405,14 +899,48 @@ func generichandle(buf *bytes.Buffer, remaddr net.Addr) (response types.DNSpacke
 				Type:  types.TXT,
 				Class: types.IN,
 				Data:  types.ToTXT(servername)}
+		} else if responseCache != nil && packet.Tsig == nil {
+			key := cacheKey(query)
+			entry, found := responseCache.Get(key)
+			if found {
+				desiredresponse = entry.Response
+				response.Wire = entry.Wire
+			} else {
+				desiredresponse = responder.Respond(query, globalConfig)
+				if desiredresponse.Cacheable && !desiredresponse.EcsUsed {
+					response.CacheKey = key
+				}
+			}
 		} else {
 			desiredresponse = responder.Respond(query, globalConfig)
 		}
+		if response.Wire == nil && (rrsetOrder != orderFixed || len(zoneOrders) > 0) {
+			counter := nextCounter()
+			var an, ns, ar bool
+			desiredresponse.Ansection, an = reorder(desiredresponse.Ansection, counter)
+			desiredresponse.Nssection, ns = reorder(desiredresponse.Nssection, counter)
+			desiredresponse.Arsection, ar = reorder(desiredresponse.Arsection, counter)
+			if an || ns || ar { // The order changes with every query
+				response.CacheKey = ""
+			}
+		}
 		response.Rcode = desiredresponse.Responsecode
+		response.Authoritative = desiredresponse.Authoritative
 		response.Ancount = uint16(len(desiredresponse.Ansection))
 		if response.Ancount > 0 {
 			response.Ansection = desiredresponse.Ansection
 		}
+		response.Nscount = uint16(len(desiredresponse.Nssection))
+		response.Nssection = desiredresponse.Nssection
+		response.Arcount = uint16(len(desiredresponse.Arsection))
+		response.Arsection = desiredresponse.Arsection
+		if desiredresponse.EcsUsed && packet.EcsAddress != nil {
+			response.EcsReply = true
+			response.EcsFamily = packet.EcsFamily
+			response.EcsSource = packet.EcsSource
+			response.EcsAddress = packet.EcsAddress
+			response.EcsScope = desiredresponse.EcsScope
+		}
 		return
 	}
 	// Else, ignore the incoming query. May be we should reply REFUSED instead?
@@ -420,14 +948,44 @@ func generichandle(buf *bytes.Buffer, remaddr net.Addr) (response types.DNSpacke
 	return
 }
 
-func udphandle(conn *net.UDPConn, remaddr net.Addr, buf *bytes.Buffer) {
+// output is the buffer where to write the response, reused from one
+// query to the next
+func udphandle(conn *net.UDPConn, remaddr net.Addr, buf *bytes.Buffer, output []byte) {
 	var response types.DNSpacket
+	start := time.Nanoseconds()
 	if debug > 1 {
 		debuglogger.Logf("%d bytes packet from %s\n", buf.Len(), remaddr)
 	}
-	response, noresponse := generichandle(buf, remaddr)
+	query := buf.Bytes() // Before generichandle consumes buf
+	response, noresponse := generichandle(buf, remaddr, conn.LocalAddr(), "udp")
 	if !noresponse {
-		binaryresponse := serialize(response)
+		if limiter != nil {
+			action, key, first := limiter.Check(remaddr, response)
+			if action != rrl.Send {
+				rrlMetric.Inc(rrl.ActionNames[action])
+			}
+			if action != rrl.Send && (first || debug > 2) {
+				mode := ""
+				if limiter.LogOnly {
+					mode = " (log only)"
+				}
+				infologger.Logf("Rate limiting responses to %s: %s%s\n",
+					key, rrl.ActionNames[action], mode)
+			}
+			if !limiter.LogOnly {
+				switch action {
+				case rrl.Drop:
+					if tap != nil {
+						tap.Log(remaddr, conn.LocalAddr(), "udp", start, query, 0, nil)
+					}
+					return
+				case rrl.Slip:
+					// RFC 2181, section 9: the client will retry with TCP
+					response.Truncated = true
+				}
+			}
+		}
+		binaryresponse := serialize(response, int(response.EdnsBufferSize), output)
 		_, error := conn.WriteTo(binaryresponse, remaddr)
 		if error != nil {
 			if debug > 2 {
@@ -435,102 +993,603 @@ func udphandle(conn *net.UDPConn, remaddr net.Addr, buf *bytes.Buffer) {
 				return
 			}
 		}
+		account(response, remaddr, "udp", len(binaryresponse), start)
+		if tap != nil {
+			tap.Log(remaddr, conn.LocalAddr(), "udp", start, query,
+				time.Nanoseconds(), binaryresponse)
+		}
 	}
 	// Else, ignore the incoming packet. May be we should reply REFUSED instead?
 }
 
-func tcphandle(connection net.Conn) {
+// Handles the queries of a TCP connection (plain or TLS, according to
+// transport) until the client closes it or stays idle for too long
+// (RFC 7766, section 6.2.3). Queries are answered in order.
+func tcphandle(connection net.Conn, transport string) {
+	tcpConnections.Inc(transport)
 	if debug > 1 {
-		debuglogger.Logf("TCP connection accepted from %s\n", connection.RemoteAddr())
+		debuglogger.Logf("%s connection accepted from %s\n", transport, connection.RemoteAddr())
 	}
+	defer connection.Close()
 	smallbuf := make([]byte, 2)
-	n, error := connection.Read(smallbuf)
-	if error != nil {
-		if debug > 2 {
-			debuglogger.Logf("Cannot read message length from TCP connection: %s\n", error)
-			return
-		}
-	}
-	msglength := binary.BigEndian.Uint16(smallbuf) // RFC 1035, section 4.2.2 "TCP usage"
-	message := make([]byte, msglength)
-	n, error = connection.Read(message)
-	if error != nil {
-		if debug > 2 {
-			debuglogger.Logf("Cannot read message from TCP connection with %s: %s\n", connection.RemoteAddr(), error)
+	for {
+		connection.SetReadTimeout(idleTimeout)
+		_, error := io.ReadFull(connection, smallbuf)
+		if error != nil {
+			if error != os.EOF && debug > 2 {
+				debuglogger.Logf("Cannot read message length from %s connection: %s\n", transport, error)
+			}
 			return
 		}
-	}
-	if debug > 1 {
-		debuglogger.Logf("%d bytes read from %s\n", n, connection.RemoteAddr())
-	}
-	response, noresponse := generichandle(bytes.NewBuffer(message), connection.RemoteAddr())
-	if !noresponse {
-		binaryresponse := serialize(response)
-		shortbuf := make([]byte, 2)
-		binary.BigEndian.PutUint16(shortbuf, uint16(len(binaryresponse)))
-		n, error := connection.Write(shortbuf)
-		if n != 2 || error != nil {
+		msglength := binary.BigEndian.Uint16(smallbuf) // RFC 1035, section 4.2.2 "TCP usage"
+		message := make([]byte, msglength)
+		n, error := io.ReadFull(connection, message)
+		if error != nil {
 			if debug > 2 {
-				debuglogger.Logf("Error in TCP message length Write: %s\n", error)
-				return
+				debuglogger.Logf("Cannot read message from %s connection with %s: %s\n", transport, connection.RemoteAddr(), error)
 			}
+			return
+		}
+		if debug > 1 {
+			debuglogger.Logf("%d bytes read from %s\n", n, connection.RemoteAddr())
 		}
-		n, error = connection.Write(binaryresponse)
+		start := time.Nanoseconds()
+		response, noresponse := generichandle(bytes.NewBuffer(message), connection.RemoteAddr(),
+			connection.LocalAddr(), transport)
+		if noresponse {
+			continue
+		}
+		binaryresponse := serialize(response, 65535, nil)
+		// Length and message in one Write, therefore in one TLS record
+		output := make([]byte, 2+len(binaryresponse))
+		binary.BigEndian.PutUint16(output, uint16(len(binaryresponse)))
+		copy(output[2:], binaryresponse)
+		_, error = connection.Write(output)
 		if error != nil {
 			if debug > 2 {
-				debuglogger.Logf("Error in TCP message Write: %s\n", error)
-				return
+				debuglogger.Logf("Error in %s message Write: %s\n", transport, error)
 			}
+			return
+		}
+		account(response, connection.RemoteAddr(), transport, len(binaryresponse), start)
+		if tap != nil {
+			tap.Log(connection.RemoteAddr(), connection.LocalAddr(), transport, start, message,
+				time.Nanoseconds(), binaryresponse)
 		}
 	}
-	connection.Close() // In theory, we may have other requests. We clearly violate the RFC by not waiting for them. TODO
 }
 
-func tcpListener(address *net.TCPAddr, comm chan bool) {
-	listener, error := net.ListenTCP("udp", address)
-	checkError("Cannot listen", error)
+func tcpListener(listener net.Listener, comm chan bool) {
 	for {
 		connection, error := listener.Accept()
 		if error != nil {
 			if debug > 1 {
 				debuglogger.Logf("Cannot accept TCP connection: %s\n", error)
-				continue
 			}
+			continue
 		}
-		go tcphandle(connection)
+		go tcphandle(connection, "tcp")
 	}
 	listener.Close()
 	comm <- true
 }
 
-func udpListener(address *net.UDPAddr, comm chan bool) {
-	listener, error := net.ListenUDP("udp", address)
-	checkError("Cannot listen", error)
+// Reads the certificate and the private key. On error, the previous
+// ones, if any, are kept.
+func loadCertificate() os.Error {
+	certificate, error := tls.LoadX509KeyPair(tlsCertificate, tlsKey)
+	if error != nil {
+		return error
+	}
+	config := &tls.Config{Rand: rand.Reader, Time: time.Seconds,
+		Certificates: []tls.Certificate{certificate}}
+	tlsMutex.Lock()
+	tlsConfig = config
+	tlsMutex.Unlock()
+	return nil
+}
+
+func tlsListener(listener net.Listener, comm chan bool) {
 	for {
-		message := make([]byte, 512) // 512 is a reasonable upper limit
-		// for *incoming* queries
+		connection, error := listener.Accept()
+		if error != nil {
+			if debug > 1 {
+				debuglogger.Logf("Cannot accept TLS connection: %s\n", error)
+			}
+			continue
+		}
+		tlsMutex.Lock()
+		config := tlsConfig
+		tlsMutex.Unlock()
+		// The handshake is done at the first Read
+		go tcphandle(tls.Server(connection, config), "tls")
+	}
+	listener.Close()
+	comm <- true
+}
+
+// DNS over HTTPS (RFC 8484). Only HTTP/1.1, although section 5.2
+// recommends HTTP/2: package http does not have it, and crypto/tls
+// cannot negotiate it (no ALPN). See the TODO in the README.
+const (
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+)
+
+type dohHandler struct {
+	local     net.Addr
+	transport string // "https" or "http" (behind a proxy)
+}
+
+// Base64url without padding (RFC 8484, section 4.1)
+func decodeBase64url(encoded string) ([]byte, os.Error) {
+	for len(encoded)%4 != 0 {
+		encoded += "="
+	}
+	decoded := make([]byte, base64.URLEncoding.DecodedLen(len(encoded)))
+	n, error := base64.URLEncoding.Decode(decoded, []byte(encoded))
+	if error != nil {
+		return nil, error
+	}
+	return decoded[0:n], nil
+}
+
+// The HTTP freshness lifetime is the minimum TTL of the answer (or
+// of the authority section, for negative answers, RFC 8484, section
+// 5.1). ok is false if there are no records.
+func minimumTTL(response types.DNSpacket) (ttl uint32, ok bool) {
+	section := response.Ansection
+	if len(section) == 0 {
+		section = response.Nssection
+	}
+	for i, rr := range section {
+		if i == 0 || rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+	}
+	return ttl, len(section) > 0
+}
+
+// The media type of a Content-Type, without the parameters (such as
+// "; charset=...") and in lower case, since it is case-insensitive
+// (RFC 2045, section 5.1).
+func mediaType(contentType string) string {
+	semicolon := strings.Index(contentType, ";")
+	if semicolon >= 0 {
+		contentType = contentType[0:semicolon]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+func (handler *dohHandler) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	var message []byte
+	var error os.Error
+	switch request.Method {
+	case "GET":
+		message, error = decodeBase64url(request.FormValue("dns"))
+		if error != nil || len(message) == 0 {
+			http.Error(w, "Missing or invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case "POST":
+		if mediaType(request.Header["Content-Type"]) != dohContentType {
+			http.Error(w, "The content type must be "+dohContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		message, error = ioutil.ReadAll(io.LimitReader(request.Body, 65535))
+		if error != nil || len(message) == 0 {
+			http.Error(w, "Cannot read the DNS message", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client, error := net.ResolveTCPAddr(w.RemoteAddr())
+	if error != nil {
+		http.Error(w, "Cannot parse the client address", http.StatusInternalServerError)
+		return
+	}
+	if debug > 1 {
+		debuglogger.Logf("%d bytes read from %s over %s\n", len(message), client, handler.transport)
+	}
+	start := time.Nanoseconds()
+	response, noresponse := generichandle(bytes.NewBuffer(message), client, handler.local, handler.transport)
+	if noresponse {
+		http.Error(w, "Not a DNS query", http.StatusBadRequest)
+		return
+	}
+	binaryresponse := serialize(response, 65535, nil)
+	w.SetHeader("Content-Type", dohContentType)
+	w.SetHeader("Content-Length", fmt.Sprintf("%d", len(binaryresponse)))
+	ttl, ok := minimumTTL(response)
+	if ok {
+		w.SetHeader("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	_, error = w.Write(binaryresponse)
+	if error != nil {
+		if debug > 2 {
+			debuglogger.Logf("Error in %s message Write: %s\n", handler.transport, error)
+		}
+		return
+	}
+	account(response, client, handler.transport, len(binaryresponse), start)
+	if tap != nil {
+		tap.Log(client, handler.local, handler.transport, start, message,
+			time.Nanoseconds(), binaryresponse)
+	}
+}
+
+// Wraps the accepted connections in TLS, with the current
+// certificate, so it can be changed on SIGHUP
+type tlsReloadListener struct {
+	net.Listener
+}
+
+func (listener tlsReloadListener) Accept() (net.Conn, os.Error) {
+	connection, error := listener.Listener.Accept()
+	if error != nil {
+		return nil, error
+	}
+	tlsMutex.Lock()
+	config := tlsConfig
+	tlsMutex.Unlock()
+	return tls.Server(connection, config), nil
+}
+
+func dohListener(listener net.Listener, transport string, comm chan bool) {
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, &dohHandler{local: listener.Addr(), transport: transport})
+	var error os.Error
+	if transport == "https" {
+		error = http.Serve(tlsReloadListener{listener}, mux)
+	} else {
+		error = http.Serve(listener, mux)
+	}
+	if error != nil {
+		crisislogger.Logf("Cannot serve DNS over %s: %s\n", transport, error)
+	}
+	comm <- true
+}
+
+// A UDP query waiting for a worker
+type udpJob struct {
+	conn    *net.UDPConn
+	remaddr net.Addr
+	message []byte // From the pool of buffers
+	n       int
+}
+
+// Statistics of the UDP queue, updated with sync/atomic since all the
+// readers share them
+type queueCounters struct {
+	received uint64
+	dropped  uint64
+}
+
+var (
+	udpQueue    chan udpJob
+	freeBuffers chan []byte // The "leaky buffer" of "Effective Go"
+	udpCounters queueCounters
+)
+
+func getBuffer() []byte {
+	select {
+	case buffer := <-freeBuffers:
+		return buffer
+	default:
+	}
+	return make([]byte, ednsPayloadSize)
+}
+
+func putBuffer(buffer []byte) {
+	select {
+	case freeBuffers <- buffer:
+	default: // The pool is full, let the garbage collector have it
+	}
+}
+
+func udpWorker() {
+	output := make([]byte, 65535) // A worker handles one query at a time
+	for job := range udpQueue {
+		udphandle(job.conn, job.remaddr, bytes.NewBuffer(job.message[0:job.n]), output)
+		putBuffer(job.message)
+	}
+}
+
+// Logs the dropped queries, at most once a minute
+func reportDrops() {
+	var reported uint64
+	for {
+		time.Sleep(60e9)
+		dropped := atomic.AddUint64(&udpCounters.dropped, 0)
+		if dropped > reported {
+			infologger.Logf("%d UDP queries dropped in the last minute, the queue is full\n",
+				dropped-reported)
+			reported = dropped
+		}
+	}
+}
+
+// Tells if the address is the wildcard one, for every interface
+func isWildcard(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil { // 0.0.0.0 may be in the IPv6 form
+		ip = ip4
+	}
+	for _, b := range ip {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Creates a UDP socket with SO_REUSEPORT, so several sockets can
+// listen on the same address and the kernel spreads the queries
+// among them. The net package cannot set options before bind(), so
+// we create the socket ourselves. For the wildcard address, it is an
+// IPv6 socket which also receives IPv4 (IPV6_V6ONLY off), or an IPv4
+// one if the host has no IPv6.
+func listenReusePort(address *net.UDPAddr) (*net.UDPConn, os.Error) {
+	var (
+		fd, errno int
+		sockaddr  syscall.Sockaddr
+	)
+	if isWildcard(address.IP) {
+		fd, errno = syscall.Socket(syscall.AF_INET6, syscall.SOCK_DGRAM, 0)
+		if errno == 0 {
+			errno = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+			if errno != 0 {
+				syscall.Close(fd)
+				return nil, os.NewSyscallError("setsockopt", errno)
+			}
+			sockaddr = &syscall.SockaddrInet6{Port: address.Port}
+		} else {
+			fd, errno = syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+			sockaddr = &syscall.SockaddrInet4{Port: address.Port}
+		}
+	} else if ipv4 := address.IP.To4(); ipv4 != nil {
+		fd, errno = syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+		sa := &syscall.SockaddrInet4{Port: address.Port}
+		copy(sa.Addr[:], ipv4)
+		sockaddr = sa
+	} else {
+		fd, errno = syscall.Socket(syscall.AF_INET6, syscall.SOCK_DGRAM, 0)
+		sa := &syscall.SockaddrInet6{Port: address.Port}
+		copy(sa.Addr[:], address.IP)
+		sockaddr = sa
+	}
+	if errno != 0 {
+		return nil, os.NewSyscallError("socket", errno)
+	}
+	errno = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1)
+	if errno == 0 {
+		errno = syscall.Bind(fd, sockaddr)
+	}
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt/bind", errno)
+	}
+	file := os.NewFile(fd, address.String())
+	conn, error := net.FilePacketConn(file)
+	file.Close() // FilePacketConn has its own copy
+	if error != nil {
+		return nil, error
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func udpReader(listener *net.UDPConn) {
+	for {
+		message := getBuffer()
 		n, remaddr, error := listener.ReadFrom(message)
 		if error != nil {
+			putBuffer(message)
 			if debug > 1 {
-				debuglogger.Logf("Cannot read UDP from %s: %s\n", remaddr.String(), error)
-				continue
+				debuglogger.Logf("Cannot read UDP: %s\n", error)
 			}
+			continue
 		}
-		buf := bytes.NewBuffer(message[0:n])
-		go udphandle(listener, remaddr, buf)
+		atomic.AddUint64(&udpCounters.received, 1)
+		select {
+		case udpQueue <- udpJob{listener, remaddr, message, n}:
+		default:
+			// No worker available and the queue is full: we drop the
+			// query rather than spawning goroutines without limit.
+			atomic.AddUint64(&udpCounters.dropped, 1)
+			putBuffer(message)
+			if debug > 2 {
+				debuglogger.Logf("Queue full, query from %s dropped\n", remaddr)
+			}
+		}
+	}
+}
+
+// Starts the readers (one per socket) and a fixed number of workers,
+// connected by a queue of bounded size
+func udpListener(listeners []*net.UDPConn, workers int, queuesize int, comm chan bool) {
+	udpQueue = make(chan udpJob, queuesize)
+	freeBuffers = make(chan []byte, queuesize+workers)
+	for i := 0; i < workers; i++ {
+		go udpWorker()
+	}
+	go reportDrops()
+	metrics.NewCounterFunc("grong_udp_dropped_total",
+		"UDP queries dropped because the queue was full",
+		func() uint64 { return atomic.AddUint64(&udpCounters.dropped, 0) })
+	for i := 0; i < len(listeners)-1; i++ {
+		go udpReader(listeners[i])
 	}
+	listener := listeners[len(listeners)-1]
+	udpReader(listener) // The last one runs in this goroutine, forever
 	listener.Close()
 	comm <- true
 }
 
+// Reads the PROXY header sent by the trusted balancers, if the
+// listener of this transport is configured for it (-proxy)
+func proxied(listener net.Listener, transport string) net.Listener {
+	if !proxyTransports[transport] {
+		return listener
+	}
+	result := proxyproto.NewListener(listener, proxyTrusted, idleTimeout)
+	if len(proxyListeners) == cap(proxyListeners) {
+		newlisteners := make([]*proxyproto.Listener, len(proxyListeners), 2*cap(proxyListeners))
+		copy(newlisteners, proxyListeners)
+		proxyListeners = newlisteners
+	}
+	proxyListeners = proxyListeners[0 : len(proxyListeners)+1]
+	proxyListeners[len(proxyListeners)-1] = result
+	return result
+}
+
+// Creates the sockets, which must be done before dropping privileges
+// since port 53 is reserved to root
+func openListeners(udpaddr *net.UDPAddr, tcpaddr *net.TCPAddr, sockets int) (udp []*net.UDPConn, tcp []*net.TCPListener) {
+	udp = make([]*net.UDPConn, sockets)
+	if sockets == 1 {
+		var error os.Error
+		udp[0], error = net.ListenUDP("udp", udpaddr)
+		checkError("Cannot listen", error)
+	} else {
+		for i := 0; i < sockets; i++ {
+			var error os.Error
+			udp[i], error = listenReusePort(udpaddr)
+			checkError("Cannot listen with SO_REUSEPORT", error)
+		}
+	}
+	tcp = make([]*net.TCPListener, 1)
+	var error os.Error
+	tcp[0], error = net.ListenTCP("tcp", tcpaddr)
+	checkError("Cannot listen", error)
+	return udp, tcp
+}
+
+// UDP and DoH queries get the address of their socket as local
+// address, not the destination of the packet (there is no
+// IP_PKTINFO here): with a wildcard socket, the "local" criteria of
+// the views would not match them, while they match over TCP.
+func checkViews(newviews []*view.View) os.Error {
+	if wildcardLocal != "" && view.UsesLocal(newviews) {
+		return os.NewError("the views cannot have local criteria when the " + wildcardLocal +
+			" listener is on the wildcard address")
+	}
+	return nil
+}
+
+// On SIGHUP, the responder reloads its data and the cache, which is
+// now obsolete, is flushed
+func signalHandler() {
+	for sig := range signal.Incoming {
+		unixsig, ok := sig.(signal.UnixSignal)
+		if !ok {
+			continue
+		}
+		switch unixsig {
+		case syscall.SIGHUP:
+			infologger.Logf("SIGHUP received, reloading\n")
+			responder.Reload()
+			if views != nil {
+				newviews, error := view.Read(viewsFile)
+				if error == nil {
+					error = checkViews(newviews)
+				}
+				if error != nil {
+					infologger.Logf("Cannot reload the views, keeping the old ones: %s\n", error)
+				} else {
+					reloadMutex.Lock()
+					views = newviews
+					reloadMutex.Unlock()
+				}
+			}
+			if accessRules != nil {
+				rules, error := acl.Read(aclFile)
+				if error != nil {
+					infologger.Logf("Cannot reload the ACLs, keeping the old ones: %s\n", error)
+				} else {
+					reloadMutex.Lock()
+					accessRules = rules
+					reloadMutex.Unlock()
+				}
+			}
+			if tlsConfig != nil {
+				error := loadCertificate()
+				if error != nil {
+					infologger.Logf("Cannot reload the TLS certificate, keeping the old one: %s\n", error)
+				}
+			}
+			if responseCache != nil {
+				responseCache.Flush()
+			}
+		case syscall.SIGINT, syscall.SIGTERM:
+			infologger.Logf("%s received, terminating\n", sig)
+			if tap != nil {
+				tap.Close()
+			}
+			os.Exit(0)
+		}
+	}
+}
+
 func main() {
 	debugptr := flag.Int("debug", 0, "Set the debug level, the higher, the more verbose")
-	nodaemonptr := flag.Bool("nodaemon", false, "Run in the foreground and not as a daemon")
+	nodaemonptr := flag.Bool("nodaemon", false, "Log to the standard error instead of syslog")
+	detachptr := flag.Bool("detach", false, "Detach from the terminal and run in the background")
 	listen := flag.String("address", ":8053", "Set the port (+optional address) to listen at")
 	nameptr := flag.String("servername", "",
 		"Set the server name (and send it to clients)")
 	helpptr := flag.Bool("help", false, "Displays usage instructions")
 	zoneptr := flag.String("domain", "", "Set the name of the zone we are authoritative for")
+	keysptr := flag.String("keys", "", "Set the file containing the TSIG keys")
+	aclptr := flag.String("acl", "", "Set the file containing the access control lists (default: no ACL)")
+	viewsptr := flag.String("views", "", "Set the file containing the views (default: no views)")
+	rrsetorderptr := flag.String("rrsetorder", "fixed",
+		"Set the order of the records within an RRset: fixed, cyclic or random")
+	rrsetorderzonesptr := flag.String("rrsetorderzones", "",
+		"Set the order in some zones, overriding -rrsetorder, for instance \"example.net=random,static.example.net=fixed\"")
+	rrlrateptr := flag.Int("rrlrate", 0,
+		"Set the maximum number of identical UDP responses per second to a network (default: no limit)")
+	rrlwindowptr := flag.Int("rrlwindow", 15, "Set the window of the rate limiting, in seconds")
+	rrlslipptr := flag.Int("rrlslip", 2,
+		"Send one out of this number of rate-limited responses truncated instead of dropping it (0: never)")
+	rrllogonlyptr := flag.Bool("rrllogonly", false, "Only log the responses which would be rate-limited")
+	metricsptr := flag.String("metrics", "",
+		"Set the address (for instance \":9153\") of the HTTP server of the Prometheus metrics (default: none)")
+	dnstapfileptr := flag.String("dnstapfile", "", "Set the file where to write the dnstap log (default: none)")
+	dnstapsocketptr := flag.String("dnstapsocket", "",
+		"Set the Unix socket where to send the dnstap log (default: none)")
+	querylogptr := flag.String("querylog", "",
+		"Set the file where to log every query, or \"syslog\" (default: no query log)")
+	querylogformatptr := flag.String("querylogformat", "text", "Set the format of the query log, text or json")
+	querylogsizeptr := flag.Int("querylogsize", 0,
+		"Set the size, in megabytes, beyond which the query log file is rotated (default: never)")
+	querylogkeepptr := flag.Int("querylogkeep", 5, "Set the number of old query log files kept")
+	cachesizeptr := flag.Int("cachesize", 0,
+		"Set the maximum number of responses in the cache (default: no cache)")
+	cachettlptr := flag.Int("cachettl", 60, "Set the maximum time a response stays in the cache, in seconds")
+	workersptr := flag.Int("workers", 64, "Set the number of goroutines handling the UDP queries")
+	queueptr := flag.Int("queue", 1024,
+		"Set the number of UDP queries waiting for a worker, beyond which they are dropped")
+	socketsptr := flag.Int("sockets", 1,
+		"Set the number of UDP sockets (with SO_REUSEPORT), each with its reader (default: one, 0: one per CPU)")
+	pidfileptr := flag.String("pidfile", "", "Set the file where to write the process ID (default: none)")
+	userptr := flag.String("user", "", "Set the user to run as, after binding the sockets (default: do not change; not on Linux)")
+	groupptr := flag.String("group", "", "Set the group to run as (default: the one of the user)")
+	chrootptr := flag.String("chroot", "", "Set the directory to chroot to, after binding the sockets (default: none)")
+	idletimeoutptr := flag.Int("idletimeout", 10,
+		"Set the time, in seconds, after which an idle TCP or TLS connection is closed")
+	tlsaddressptr := flag.String("tlsaddress", "",
+		"Set the port (+optional address) of DNS over TLS, for instance \":853\" (default: none)")
+	httpsaddressptr := flag.String("httpsaddress", "",
+		"Set the port (+optional address) of DNS over HTTPS, for instance \":443\" (default: none)")
+	httpaddressptr := flag.String("httpaddress", "",
+		"Set the port (+optional address) of DNS over plain HTTP, behind a proxy (default: none)")
+	proxyptr := flag.String("proxy", "",
+		"Set the listeners (among tcp, tls, https and http, separated by commas) which accept the PROXY protocol (default: none)")
+	proxytrustedptr := flag.String("proxytrusted", "",
+		"Set the prefixes (separated by commas) of the balancers allowed to send a PROXY header")
+	tlscertptr := flag.String("tlscert", "", "Set the file containing the TLS certificate (PEM)")
+	tlskeyptr := flag.String("tlskey", "", "Set the file containing the TLS private key (PEM)")
 
 	flag.Parse()
 	help := *helpptr
@@ -574,12 +1633,255 @@ func main() {
 		crisislogger = log.New(os.Stderr, nil, "[FATAL] ",
 			loggerOptions)
 	}
+	if *detachptr && !daemon {
+		fatal("-detach needs syslog, it cannot be used with -nodaemon")
+	}
+	if *userptr != "" && !gdaemon.SetuidSupported() {
+		fatal("-user is not possible on this system, since setuid() changes only one thread: use socket activation")
+	}
+	if *detachptr && !gdaemon.UnderSystemd() {
+		error = gdaemon.Detach()
+		checkError("Cannot detach", error)
+	}
+	if *keysptr != "" {
+		tsigKeys, error = tsig.ReadKeys(*keysptr)
+		checkError("Cannot read the TSIG keys", error)
+	} else {
+		tsigKeys = make(map[string]*tsig.Key)
+	}
+	if *aclptr != "" {
+		aclFile = *aclptr
+		accessRules, error = acl.Read(aclFile)
+		checkError("Cannot read the ACLs", error)
+	}
+	var exists bool
+	rrsetOrder, exists = orderNames[*rrsetorderptr]
+	if !exists {
+		fatal("-rrsetorder must be fixed, cyclic or random")
+	}
+	zoneOrders = make(map[string]int)
+	if *rrsetorderzonesptr != "" {
+		for _, item := range strings.Split(*rrsetorderzonesptr, ",", -1) {
+			equal := strings.Index(item, "=")
+			if equal <= 0 {
+				fatal(fmt.Sprintf("Invalid item \"%s\" in -rrsetorderzones", item))
+			}
+			zonename := strings.ToLower(item[0:equal])
+			if len(zonename) > 1 && zonename[len(zonename)-1] == '.' {
+				zonename = zonename[0 : len(zonename)-1]
+			}
+			zoneOrders[zonename], exists = orderNames[item[equal+1:]]
+			if !exists {
+				fatal(fmt.Sprintf("Invalid order in \"%s\" in -rrsetorderzones", item))
+			}
+		}
+	}
+	prng.Seed(time.Nanoseconds())
+	if *viewsptr != "" {
+		viewsFile = *viewsptr
+		views, error = view.Read(viewsFile)
+		checkError("Cannot read the views", error)
+	}
+	if *rrlrateptr > 0 {
+		if *rrlwindowptr < 1 || *rrlslipptr < 0 {
+			fatal("Invalid rate limiting options")
+		}
+		limiter = rrl.New(*rrlrateptr, *rrlwindowptr, *rrlslipptr, *rrllogonlyptr)
+	}
+	if *cachesizeptr > 0 {
+		if *cachettlptr < 1 {
+			fatal("Invalid -cachettl option")
+		}
+		responseCache = cache.New(*cachesizeptr, int64(*cachettlptr))
+		metrics.NewCounterFunc("grong_cache_hits_total", "Responses sent from the cache",
+			func() uint64 {
+				hits, _ := responseCache.Statistics()
+				return hits
+			})
+		metrics.NewCounterFunc("grong_cache_misses_total", "Cacheable queries not found in the cache",
+			func() uint64 {
+				_, misses := responseCache.Statistics()
+				return misses
+			})
+	}
+	if *dnstapfileptr != "" || *dnstapsocketptr != "" {
+		identity := *nameptr
+		if *dnstapfileptr != "" {
+			tap, error = dnstap.NewFile(*dnstapfileptr, identity, "GRONG")
+		} else {
+			tap, error = dnstap.NewUnix(*dnstapsocketptr, identity, "GRONG")
+		}
+		checkError("Cannot start dnstap", error)
+		metrics.NewCounterFunc("grong_dnstap_dropped_total",
+			"dnstap messages dropped because the queue was full", func() uint64 { return tap.Dropped() })
+	}
+	if *querylogptr != "" {
+		if *querylogformatptr != "text" && *querylogformatptr != "json" {
+			fatal("The query log format must be text or json")
+		}
+		json := *querylogformatptr == "json"
+		if *querylogptr == "syslog" {
+			queryLogger, error = querylog.NewSyslog(json)
+		} else {
+			queryLogger, error = querylog.NewFile(*querylogptr, json,
+				int64(*querylogsizeptr)*1024*1024, *querylogkeepptr)
+		}
+		checkError("Cannot open the query log", error)
+	}
 	responder.Init(flag.LastOption())
+	go signalHandler()
+	if *metricsptr != "" {
+		go func() {
+			error := metrics.Serve(*metricsptr)
+			checkError("Cannot serve the metrics", error)
+		}()
+	}
 	infologger.Logf("%s", fmt.Sprintf("Starting%s%s...", namemsg, zonemsg))
+	if *workersptr < 1 || *queueptr < 1 || *socketsptr < 0 {
+		fatal("Invalid -workers, -queue or -sockets option")
+	}
+	if *idletimeoutptr < 1 {
+		fatal("Invalid -idletimeout option")
+	}
+	idleTimeout = int64(*idletimeoutptr) * 1e9
+	proxyTransports = make(map[string]bool)
+	proxyListeners = make([]*proxyproto.Listener, 0, 4)
+	if *proxyptr != "" {
+		for _, transport := range strings.Split(*proxyptr, ",", -1) {
+			switch transport {
+			case "tcp", "tls", "https", "http":
+				proxyTransports[transport] = true
+			default:
+				fatal(fmt.Sprintf("Unknown listener \"%s\" in -proxy", transport))
+			}
+		}
+		proxyTrusted, error = prefix.ParseList(*proxytrustedptr)
+		checkError("Invalid -proxytrusted option", error)
+		if len(proxyTrusted) == 0 {
+			fatal("-proxy requires -proxytrusted")
+		}
+		metrics.NewCounterFunc("grong_proxy_failures_total",
+			"Connections from trusted balancers closed because of an invalid or missing PROXY header",
+			func() uint64 {
+				total := uint64(0)
+				for _, listener := range proxyListeners {
+					total += listener.Failed()
+				}
+				return total
+			})
+	}
+	var tlsaddr, httpsaddr, httpaddr *net.TCPAddr
+	if *tlsaddressptr != "" {
+		tlsaddr, error = net.ResolveTCPAddr(*tlsaddressptr)
+		checkError(fmt.Sprintf("Cannot parse \"%s\"", *tlsaddressptr), error)
+	}
+	if *httpsaddressptr != "" {
+		httpsaddr, error = net.ResolveTCPAddr(*httpsaddressptr)
+		checkError(fmt.Sprintf("Cannot parse \"%s\"", *httpsaddressptr), error)
+	}
+	if *httpaddressptr != "" {
+		httpaddr, error = net.ResolveTCPAddr(*httpaddressptr)
+		checkError(fmt.Sprintf("Cannot parse \"%s\"", *httpaddressptr), error)
+	}
+	if tlsaddr != nil || httpsaddr != nil {
+		if *tlscertptr == "" || *tlskeyptr == "" {
+			fatal("-tlsaddress and -httpsaddress require -tlscert and -tlskey")
+		}
+		tlsCertificate = *tlscertptr
+		tlsKey = *tlskeyptr
+		error = loadCertificate()
+		checkError("Cannot load the TLS certificate", error)
+	}
+	sockets := *socketsptr
+	if sockets == 0 {
+		sockets = runtime.GOMAXPROCS(0)
+	}
+	udplisteners, tcplisteners, error := gdaemon.SystemdListeners()
+	checkError("Cannot use the sockets passed by systemd", error)
+	var tlslistener, httpslistener, httplistener *net.TCPListener
+	if len(udplisteners) == 0 && len(tcplisteners) == 0 {
+		udplisteners, tcplisteners = openListeners(udpaddr, tcpaddr, sockets)
+		if tlsaddr != nil {
+			tlslistener, error = net.ListenTCP("tcp", tlsaddr)
+			checkError("Cannot listen for TLS", error)
+		}
+		if httpsaddr != nil {
+			httpslistener, error = net.ListenTCP("tcp", httpsaddr)
+			checkError("Cannot listen for HTTPS", error)
+		}
+		if httpaddr != nil {
+			httplistener, error = net.ListenTCP("tcp", httpaddr)
+			checkError("Cannot listen for HTTP", error)
+		}
+	} else {
+		// The other sockets are recognized by their port
+		plainlisteners := make([]*net.TCPListener, 0, len(tcplisteners))
+		for _, listener := range tcplisteners {
+			port := listener.Addr().(*net.TCPAddr).Port
+			switch {
+			case tlsaddr != nil && port == tlsaddr.Port:
+				tlslistener = listener
+			case httpsaddr != nil && port == httpsaddr.Port:
+				httpslistener = listener
+			case httpaddr != nil && port == httpaddr.Port:
+				httplistener = listener
+			default:
+				plainlisteners = plainlisteners[0 : len(plainlisteners)+1]
+				plainlisteners[len(plainlisteners)-1] = listener
+			}
+		}
+		tcplisteners = plainlisteners
+		if len(udplisteners) == 0 || len(tcplisteners) == 0 {
+			fatal("systemd must pass both UDP and TCP sockets")
+		}
+		if (tlsaddr != nil && tlslistener == nil) || (httpsaddr != nil && httpslistener == nil) ||
+			(httpaddr != nil && httplistener == nil) {
+			fatal("systemd did not pass the socket of -tlsaddress, -httpsaddress or -httpaddress")
+		}
+	}
+	for _, conn := range udplisteners {
+		if isWildcard(conn.LocalAddr().(*net.UDPAddr).IP) {
+			wildcardLocal = "udp"
+		}
+	}
+	if httpslistener != nil && isWildcard(httpslistener.Addr().(*net.TCPAddr).IP) {
+		wildcardLocal = "https"
+	}
+	if httplistener != nil && isWildcard(httplistener.Addr().(*net.TCPAddr).IP) {
+		wildcardLocal = "http"
+	}
+	error = checkViews(views)
+	checkError("Invalid views", error)
+	if *pidfileptr != "" {
+		error = gdaemon.WritePidFile(*pidfileptr)
+		checkError("Cannot write the PID file", error)
+	}
+	if *userptr != "" || *groupptr != "" || *chrootptr != "" {
+		if *groupptr != "" && *userptr == "" {
+			fatal("-group requires -user")
+		}
+		error = gdaemon.DropPrivileges(*userptr, *groupptr, *chrootptr)
+		checkError("Cannot drop privileges", error)
+	}
 	udpchan := make(chan bool)
-	go udpListener(udpaddr, udpchan)
+	go udpListener(udplisteners, *workersptr, *queueptr, udpchan)
 	tcpchan := make(chan bool)
-	go tcpListener(tcpaddr, tcpchan)
+	for _, listener := range tcplisteners {
+		go tcpListener(proxied(listener, "tcp"), tcpchan)
+	}
+	if tlslistener != nil {
+		go tlsListener(proxied(tlslistener, "tls"), tcpchan)
+	}
+	if httpslistener != nil {
+		go dohListener(proxied(httpslistener, "https"), "https", tcpchan)
+	}
+	if httplistener != nil {
+		go dohListener(proxied(httplistener, "http"), "http", tcpchan)
+	}
+	error = gdaemon.Notify("READY=1")
+	if error != nil {
+		infologger.Logf("Cannot notify systemd: %s\n", error)
+	}
 
 	<-udpchan // Just to wait the listener, otherwise, the Go runtime ends
 	// even if there are live goroutines
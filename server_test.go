@@ -0,0 +1,108 @@
+/* Benchmarks of the handling of a query, with the responder linked as
+   responder.go. "make bench" runs them with each responder. The
+   options of the responder are in the environment variable
+   GRONG_BENCH_ARGS and the name to query in GRONG_BENCH_QNAME.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"./responder"
+	"./types"
+)
+
+var (
+	benchReady   bool
+	benchQuery   []byte
+	benchClient  net.Addr
+	benchLocal   net.Addr
+	benchOutput  = make([]byte, 65535)
+	benchDefault = "www.example.net"
+)
+
+func benchSetup(b *testing.B) {
+	if benchReady {
+		return
+	}
+	debuglogger = log.New(os.Stderr, nil, "[DEBUG] ", loggerOptions)
+	infologger = log.New(os.Stderr, nil, "[INFO] ", loggerOptions)
+	crisislogger = log.New(os.Stderr, nil, "[FATAL] ", loggerOptions)
+	globalConfig = make(map[string]interface{})
+	globalConfig["servername"] = "grong.bench.test"
+	os.Args = []string{"grong"}
+	args := strings.Fields(os.Getenv("GRONG_BENCH_ARGS"))
+	if len(args) > 0 {
+		os.Args = make([]string, len(args)+1)
+		os.Args[0] = "grong"
+		copy(os.Args[1:], args)
+	}
+	responder.Init(1)
+	qname := os.Getenv("GRONG_BENCH_QNAME")
+	if qname == "" {
+		qname = benchDefault
+	}
+	// A query for the A records, with EDNS and the DO bit
+	query := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(query[0:2], 1234)
+	binary.BigEndian.PutUint16(query[4:6], 1)   // Qdcount
+	binary.BigEndian.PutUint16(query[10:12], 1) // Arcount
+	query, ok := types.AppendName(query, qname)
+	if !ok {
+		b.Fatalf("Invalid name %s", qname)
+	}
+	query = types.AppendShort(query, types.A)
+	query = types.AppendShort(query, types.IN)
+	query, _ = types.AppendRR(query, types.RR{Name: ".", Type: types.OPT,
+		Class: ednsPayloadSize, TTL: 0x8000, Data: nil})
+	benchQuery = query
+	benchClient, _ = net.ResolveUDPAddr("192.0.2.53:5353")
+	benchLocal, _ = net.ResolveUDPAddr("198.51.100.1:53")
+	benchReady = true
+}
+
+func BenchmarkParse(b *testing.B) {
+	b.StopTimer()
+	benchSetup(b)
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		_, ok := parse(bytes.NewBuffer(benchQuery))
+		if !ok {
+			b.Fatalf("Cannot parse the query")
+		}
+	}
+}
+
+// Parsing, then the responder
+func BenchmarkRespond(b *testing.B) {
+	b.StopTimer()
+	benchSetup(b)
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		_, noresponse := generichandle(bytes.NewBuffer(benchQuery), benchClient, benchLocal, "udp")
+		if noresponse {
+			b.Fatalf("No response")
+		}
+	}
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	b.StopTimer()
+	benchSetup(b)
+	response, _ := generichandle(bytes.NewBuffer(benchQuery), benchClient, benchLocal, "udp")
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		serialize(response, int(response.EdnsBufferSize), benchOutput)
+	}
+}
@@ -0,0 +1,165 @@
+/* The "space-saving" algorithm of Metwally, Agrawal and El Abbadi
+   ("Efficient Computation of Frequent and Top-k Elements in Data
+   Streams", 2005): it finds the most frequent keys of a stream (the
+   "heavy hitters") with a fixed number of counters, so with bounded
+   memory, whatever the number of distinct keys.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package spacesaving
+
+import (
+	"sort"
+	"sync"
+)
+
+type Item struct {
+	Key   string
+	Count uint64 // An overestimation of the real count...
+	Error uint64 // ...by at most this value
+}
+
+// The "Stream-Summary" structure of the paper: the counters with the
+// same count are in the same bucket and the buckets are linked in
+// increasing order of count. Incrementing a counter and finding the
+// smallest one are therefore done in constant time.
+type bucket struct {
+	count      uint64
+	counters   *counter // Doubly-linked list
+	prev, next *bucket
+}
+
+type counter struct {
+	Item
+	bucket     *bucket
+	prev, next *counter
+}
+
+type Summary struct {
+	capacity int
+	counters map[string]*counter
+	smallest *bucket // The first bucket
+	mutex    sync.Mutex
+}
+
+func New(capacity int) *Summary {
+	return &Summary{capacity: capacity, counters: make(map[string]*counter, capacity)}
+}
+
+// Inserts the bucket after another one, or first if after is nil
+func (summary *Summary) link(b *bucket, after *bucket) {
+	b.prev = after
+	if after == nil {
+		b.next = summary.smallest
+		summary.smallest = b
+	} else {
+		b.next = after.next
+		after.next = b
+	}
+	if b.next != nil {
+		b.next.prev = b
+	}
+}
+
+func (summary *Summary) unlink(b *bucket) {
+	if b.prev == nil {
+		summary.smallest = b.next
+	} else {
+		b.prev.next = b.next
+	}
+	if b.next != nil {
+		b.next.prev = b.prev
+	}
+}
+
+func (b *bucket) push(c *counter) {
+	c.bucket = b
+	c.Count = b.count
+	c.prev = nil
+	c.next = b.counters
+	if b.counters != nil {
+		b.counters.prev = c
+	}
+	b.counters = c
+}
+
+func (b *bucket) remove(c *counter) {
+	if c.prev == nil {
+		b.counters = c.next
+	} else {
+		c.prev.next = c.next
+	}
+	if c.next != nil {
+		c.next.prev = c.prev
+	}
+}
+
+// Moves the counter to the bucket of the next count, which is created
+// if needed, just after the current one
+func (summary *Summary) increment(c *counter) {
+	old := c.bucket
+	next := old.next
+	if next == nil || next.count != old.count+1 {
+		next = &bucket{count: old.count + 1}
+		summary.link(next, old)
+	}
+	old.remove(c)
+	next.push(c)
+	if old.counters == nil {
+		summary.unlink(old)
+	}
+}
+
+// Counts one occurrence of the key. When all the counters are used,
+// the smallest one is given to the new key, which inherits its count.
+func (summary *Summary) Add(key string) {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	c, exists := summary.counters[key]
+	if exists {
+		summary.increment(c)
+		return
+	}
+	if len(summary.counters) < summary.capacity {
+		c = &counter{Item: Item{Key: key}}
+		first := summary.smallest
+		if first == nil || first.count != 1 {
+			first = &bucket{count: 1}
+			summary.link(first, nil)
+		}
+		first.push(c)
+		summary.counters[key] = c
+		return
+	}
+	c = summary.smallest.counters
+	summary.counters[c.Key] = nil, false
+	c.Key = key
+	c.Error = c.Count
+	summary.counters[key] = c
+	summary.increment(c)
+}
+
+type byCount []Item
+
+func (items byCount) Len() int { return len(items) }
+
+func (items byCount) Less(i, j int) bool { return items[i].Count > items[j].Count }
+
+func (items byCount) Swap(i, j int) { items[i], items[j] = items[j], items[i] }
+
+// Returns the n most frequent keys, the most frequent first
+func (summary *Summary) Top(n int) []Item {
+	summary.mutex.Lock()
+	result := make([]Item, 0, len(summary.counters))
+	for _, c := range summary.counters {
+		result = result[0 : len(result)+1]
+		result[len(result)-1] = c.Item
+	}
+	summary.mutex.Unlock()
+	sort.Sort(byCount(result))
+	if len(result) > n {
+		result = result[0:n]
+	}
+	return result
+}
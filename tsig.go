@@ -0,0 +1,303 @@
+/* TSIG (RFC 8945): authentication of DNS messages with a secret
+   shared between the client and the server.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package tsig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	"./types"
+)
+
+const (
+	// The only algorithms we support. RFC 8945, section 6
+	HMACSHA256 = "hmac-sha256"
+	HMACSHA512 = "hmac-sha512"
+)
+
+type Key struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+func (key *Key) newHash() hash.Hash {
+	switch key.Algorithm {
+	case HMACSHA256:
+		return hmac.New(sha256.New(), key.Secret)
+	case HMACSHA512:
+		return hmac.New(sha512.New(), key.Secret)
+	}
+	return nil
+}
+
+func macSize(algorithm string) int {
+	switch algorithm {
+	case HMACSHA256:
+		return sha256.Size
+	case HMACSHA512:
+		return sha512.Size
+	}
+	return 0
+}
+
+// Reads the keys from a file. Each line is "name algorithm secret",
+// the secret being in Base64, like in the output of tsig-keygen. Lines
+// starting with a # are comments.
+func ReadKeys(filename string) (keys map[string]*Key, error os.Error) {
+	keys = make(map[string]*Key)
+	content, error := ioutil.ReadFile(filename)
+	if error != nil {
+		return nil, error
+	}
+	for linenum, line := range strings.Split(string(content), "\n", -1) {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, os.NewError(fmt.Sprintf("%s:%d: three fields expected, got %d",
+				filename, linenum+1, len(fields)))
+		}
+		name := canonical(fields[0])
+		if !types.ValidName(name) {
+			return nil, os.NewError(fmt.Sprintf("%s:%d: invalid key name %s",
+				filename, linenum+1, name))
+		}
+		algorithm := canonical(fields[1])
+		if macSize(algorithm) == 0 {
+			return nil, os.NewError(fmt.Sprintf("%s:%d: unsupported algorithm %s",
+				filename, linenum+1, algorithm))
+		}
+		secret := make([]byte, base64.StdEncoding.DecodedLen(len(fields[2])))
+		n, error := base64.StdEncoding.Decode(secret, []byte(fields[2]))
+		if error != nil {
+			return nil, os.NewError(fmt.Sprintf("%s:%d: invalid secret: %s",
+				filename, linenum+1, error))
+		}
+		keys[name] = &Key{Name: name, Algorithm: algorithm, Secret: secret[0:n]}
+	}
+	return keys, nil
+}
+
+// Names are compared and hashed in lowercase and without the final
+// dot, like the Qname of a DNSquery
+func canonical(name string) string {
+	name = strings.ToLower(name)
+	if len(name) > 1 && name[len(name)-1] == '.' {
+		name = name[0 : len(name)-1]
+	}
+	return name
+}
+
+// Parses the RDATA of a TSIG record. name is the owner name, the name
+// of the key. Both names are copied in the TSIG record of the reply,
+// so they must be valid (see types.ValidName), otherwise it is a
+// format error.
+func Parse(name string, rdata []byte) (record *types.TSIGrecord, ok bool) {
+	record = new(types.TSIGrecord)
+	record.Name = canonical(name)
+	algorithm, last, ok := types.Decode(rdata) // Compression is forbidden, RFC 8945, section 4.2
+	if !ok || !types.ValidName(record.Name) || !types.ValidName(algorithm) {
+		return nil, false
+	}
+	record.Algorithm = canonical(algorithm)
+	if last+10 > len(rdata) {
+		return nil, false
+	}
+	record.TimeSigned = uint64(binary.BigEndian.Uint16(rdata[last:last+2]))<<32 |
+		uint64(binary.BigEndian.Uint32(rdata[last+2:last+6]))
+	record.Fudge = binary.BigEndian.Uint16(rdata[last+6 : last+8])
+	macsize := int(binary.BigEndian.Uint16(rdata[last+8 : last+10]))
+	last += 10
+	if last+macsize+6 > len(rdata) {
+		return nil, false
+	}
+	record.MAC = rdata[last : last+macsize]
+	last += macsize
+	record.OriginalId = binary.BigEndian.Uint16(rdata[last : last+2])
+	record.Error = binary.BigEndian.Uint16(rdata[last+2 : last+4])
+	otherlen := int(binary.BigEndian.Uint16(rdata[last+4 : last+6]))
+	last += 6
+	if last+otherlen != len(rdata) {
+		return nil, false
+	}
+	record.Other = rdata[last : last+otherlen]
+	// RFC 8945, section 5.2.2.1: a MAC longer than the hash, or
+	// truncated to less than half of it (or to less than 10 bytes) is
+	// a format error. We cannot check for unknown algorithms, it will
+	// be a BADKEY later.
+	fullsize := macSize(record.Algorithm)
+	if fullsize != 0 {
+		minsize := fullsize / 2
+		if minsize < 10 {
+			minsize = 10
+		}
+		if macsize > fullsize || macsize < minsize {
+			return nil, false
+		}
+	}
+	return record, true
+}
+
+func putTime(buf *bytes.Buffer, t uint64) {
+	temp := make([]byte, 6)
+	binary.BigEndian.PutUint16(temp[0:2], uint16(t>>32))
+	binary.BigEndian.PutUint32(temp[2:6], uint32(t))
+	buf.Write(temp)
+}
+
+func putShort(buf *bytes.Buffer, i uint16) {
+	temp := make([]byte, 2)
+	binary.BigEndian.PutUint16(temp, i)
+	buf.Write(temp)
+}
+
+// The "TSIG variables" of RFC 8945, section 4.3.3, which are hashed
+// after the message
+func variables(record *types.TSIGrecord) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(types.Encode(record.Name))
+	putShort(buf, types.ANYCLASS)
+	buf.Write([]byte{0, 0, 0, 0}) // TTL
+	buf.Write(types.Encode(record.Algorithm))
+	putTime(buf, record.TimeSigned)
+	putShort(buf, record.Fudge)
+	putShort(buf, record.Error)
+	putShort(buf, uint16(len(record.Other)))
+	buf.Write(record.Other)
+	return buf.Bytes()
+}
+
+// Computes the MAC of a message. priorMAC is the MAC of the request
+// (for a response), nil if there is none.
+func computeMAC(key *Key, priorMAC []byte, message []byte, record *types.TSIGrecord) []byte {
+	h := key.newHash()
+	if priorMAC != nil {
+		temp := make([]byte, 2)
+		binary.BigEndian.PutUint16(temp, uint16(len(priorMAC)))
+		h.Write(temp)
+		h.Write(priorMAC)
+	}
+	h.Write(message)
+	h.Write(variables(record))
+	return h.Sum()
+}
+
+// Verify checks the TSIG record of a received request. message is
+// the complete message, as received. It returns the key used (nil if
+// unknown) and the TSIG error, 0 if everything is fine. Otherwise,
+// the reply must have the rcode NOTAUTH.
+func Verify(message []byte, record *types.TSIGrecord, keys map[string]*Key) (key *Key, tsigerror uint16) {
+	key, exists := keys[record.Name]
+	if !exists || key.Algorithm != record.Algorithm {
+		return nil, types.BADKEY
+	}
+	// The MAC is computed on the message without the TSIG record, so
+	// with ARCOUNT decremented, and with the original ID
+	// (RFC 8945, section 4.3.1)
+	unsigned := make([]byte, record.Start)
+	copy(unsigned, message[0:record.Start])
+	binary.BigEndian.PutUint16(unsigned[0:2], record.OriginalId)
+	binary.BigEndian.PutUint16(unsigned[10:12], binary.BigEndian.Uint16(unsigned[10:12])-1)
+	mac := computeMAC(key, nil, unsigned, record)
+	// In constant time, so the MAC cannot be guessed byte after byte
+	if subtle.ConstantTimeCompare(mac[0:len(record.MAC)], record.MAC) != 1 {
+		return key, types.BADSIG
+	}
+	// The time is checked only after the MAC, RFC 8945, section 5.2.3
+	now := uint64(time.Seconds())
+	if now > record.TimeSigned+uint64(record.Fudge) ||
+		now+uint64(record.Fudge) < record.TimeSigned {
+		return key, types.BADTIME
+	}
+	return key, 0
+}
+
+// Appends a TSIG record to a message and increments its ARCOUNT.
+func appendRecord(message []byte, record *types.TSIGrecord) []byte {
+	rdata := new(bytes.Buffer)
+	rdata.Write(types.Encode(record.Algorithm))
+	putTime(rdata, record.TimeSigned)
+	putShort(rdata, record.Fudge)
+	putShort(rdata, uint16(len(record.MAC)))
+	rdata.Write(record.MAC)
+	putShort(rdata, record.OriginalId)
+	putShort(rdata, record.Error)
+	putShort(rdata, uint16(len(record.Other)))
+	rdata.Write(record.Other)
+	rr := new(bytes.Buffer)
+	rr.Write(types.Encode(record.Name))
+	putShort(rr, types.TSIG)
+	putShort(rr, types.ANYCLASS)
+	rr.Write([]byte{0, 0, 0, 0}) // TTL
+	putShort(rr, uint16(rdata.Len()))
+	rr.Write(rdata.Bytes())
+	result := bytes.Add(make([]byte, 0, len(message)+rr.Len()), message)
+	result = bytes.Add(result, rr.Bytes())
+	binary.BigEndian.PutUint16(result[10:12], binary.BigEndian.Uint16(result[10:12])+1)
+	return result
+}
+
+// The TSIG record of a reply, built from the one of the request
+func replyRecord(request *types.TSIGrecord, tsigerror uint16) (record *types.TSIGrecord) {
+	record = new(types.TSIGrecord)
+	record.Name = request.Name
+	record.Algorithm = request.Algorithm
+	record.Fudge = request.Fudge
+	record.OriginalId = request.OriginalId
+	record.Error = tsigerror
+	now := uint64(time.Seconds())
+	if tsigerror == types.BADTIME {
+		// We keep the client's time and tell it our time, RFC
+		// 8945, section 5.2.3
+		record.TimeSigned = request.TimeSigned
+		buf := new(bytes.Buffer)
+		putTime(buf, now)
+		record.Other = buf.Bytes()
+	} else {
+		record.TimeSigned = now
+	}
+	return
+}
+
+// Length is the size of the TSIG record that Sign will add, so that
+// the caller can keep room for it before filling the message.
+func Length(request *types.TSIGrecord, tsigerror uint16, key *Key) int {
+	length := types.NameLength(request.Name) + 10 + // Type, class, TTL and RDLENGTH
+		types.NameLength(request.Algorithm) + 16 // The fixed fields of the RDATA
+	if key != nil && tsigerror != types.BADKEY && tsigerror != types.BADSIG {
+		length += macSize(key.Algorithm)
+	}
+	if tsigerror == types.BADTIME {
+		length += 6
+	}
+	return length
+}
+
+// Sign adds a TSIG record to a response. request is the TSIG record
+// of the request and tsigerror the result of Verify. For BADKEY and
+// BADSIG, the response is not actually signed (RFC 8945, section
+// 5.3.2) and key may be nil.
+func Sign(message []byte, request *types.TSIGrecord, tsigerror uint16, key *Key) []byte {
+	record := replyRecord(request, tsigerror)
+	if key != nil && tsigerror != types.BADKEY && tsigerror != types.BADSIG {
+		record.MAC = computeMAC(key, request.MAC, message, record)
+	}
+	return appendRecord(message, record)
+}
@@ -0,0 +1,203 @@
+/* Tests of TSIG, with a MAC computed independently (with Python's
+   hmac module) for the known vector.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package tsig
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+	"./types"
+)
+
+const (
+	testKeyName = "key.example.com"
+	testTime    = 1600000000 // 2020-09-13, far outside of the fudge
+	// HMAC-SHA256 of the query of testMessage, signed at testTime
+	testMAC = "1d3cc4582b8219844214c0ba129cd645afe25ea112c5414081140f3c15b8a1c0"
+)
+
+var testKey = &Key{Name: testKeyName, Algorithm: HMACSHA256,
+	Secret: []byte("grong-tsig-test-secret-32-bytes!")}
+
+func testKeys() map[string]*Key {
+	keys := make(map[string]*Key)
+	keys[testKeyName] = testKey
+	return keys
+}
+
+func testRdata(algorithm string, timeSigned uint64, mac []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(types.Encode(algorithm))
+	putTime(buf, timeSigned)
+	putShort(buf, 300) // Fudge
+	putShort(buf, uint16(len(mac)))
+	buf.Write(mac)
+	putShort(buf, 0x1234) // Original ID
+	putShort(buf, 0)      // Error
+	putShort(buf, 0)      // Other length
+	return buf.Bytes()
+}
+
+// A query for example.com/A with ID 0x1234, followed by a TSIG record
+// with this MAC. Returns the message and its parsed TSIG record.
+func testMessage(t *testing.T, timeSigned uint64, mac []byte) ([]byte, *types.TSIGrecord) {
+	message := []byte{0x12, 0x34, 0, 0, 0, 1, 0, 0, 0, 0, 0, 1}
+	message = bytes.Add(message, types.Encode("example.com"))
+	message = bytes.Add(message, []byte{0, 1, 0, 1})
+	start := len(message)
+	rdata := testRdata(HMACSHA256, timeSigned, mac)
+	rr := new(bytes.Buffer)
+	rr.Write(types.Encode(testKeyName))
+	putShort(rr, types.TSIG)
+	putShort(rr, types.ANYCLASS)
+	rr.Write([]byte{0, 0, 0, 0})
+	putShort(rr, uint16(len(rdata)))
+	rr.Write(rdata)
+	message = bytes.Add(message, rr.Bytes())
+	record, ok := Parse(testKeyName, rdata)
+	if !ok {
+		t.Fatalf("Cannot parse the TSIG record")
+	}
+	record.Start = start
+	return message, record
+}
+
+func knownMAC(t *testing.T) []byte {
+	mac, error := hex.DecodeString(testMAC)
+	if error != nil {
+		t.Fatalf("Invalid hex: %s", error)
+	}
+	return mac
+}
+
+// The MAC is checked before the time, so a good MAC with an old time
+// gives BADTIME and a bad one BADSIG.
+func TestVerify(t *testing.T) {
+	keys := testKeys()
+	mac := knownMAC(t)
+	message, record := testMessage(t, testTime, mac)
+	if _, tsigerror := Verify(message, record, keys); tsigerror != types.BADTIME {
+		t.Errorf("Known MAC: error %d instead of BADTIME", tsigerror)
+	}
+	message, record = testMessage(t, testTime, mac[0:16])
+	if _, tsigerror := Verify(message, record, keys); tsigerror != types.BADTIME {
+		t.Errorf("Known MAC truncated to 16 bytes: error %d instead of BADTIME", tsigerror)
+	}
+	bad := bytes.Add(nil, mac)
+	bad[31] ^= 1
+	message, record = testMessage(t, testTime, bad)
+	if _, tsigerror := Verify(message, record, keys); tsigerror != types.BADSIG {
+		t.Errorf("Wrong MAC: error %d instead of BADSIG", tsigerror)
+	}
+	keys[testKeyName] = nil, false
+	if key, tsigerror := Verify(message, record, keys); key != nil || tsigerror != types.BADKEY {
+		t.Errorf("Unknown key: error %d instead of BADKEY", tsigerror)
+	}
+	// A request signed now is accepted
+	keys = testKeys()
+	now := uint64(time.Seconds())
+	message, record = testMessage(t, now, make([]byte, 32))
+	unsigned := bytes.Add(nil, message[0:record.Start])
+	unsigned[11] = 0 // ARCOUNT without the TSIG record
+	message, record = testMessage(t, now, computeMAC(testKey, nil, unsigned, record))
+	if key, tsigerror := Verify(message, record, keys); key != testKey || tsigerror != 0 {
+		t.Errorf("Current request: error %d", tsigerror)
+	}
+}
+
+// Signs a response and parses the TSIG record added
+func signAndParse(t *testing.T, response []byte, request *types.TSIGrecord, tsigerror uint16) *types.TSIGrecord {
+	signed := Sign(response, request, tsigerror, testKey)
+	if len(signed)-len(response) != Length(request, tsigerror, testKey) {
+		t.Errorf("TSIG record of %d bytes, Length says %d", len(signed)-len(response),
+			Length(request, tsigerror, testKey))
+	}
+	if binary.BigEndian.Uint16(signed[10:12]) != binary.BigEndian.Uint16(response[10:12])+1 {
+		t.Errorf("ARCOUNT not incremented")
+	}
+	rdata := signed[len(response)+types.NameLength(testKeyName)+10:]
+	record, ok := Parse(testKeyName, rdata)
+	if !ok {
+		t.Fatalf("Cannot parse the TSIG record of the response")
+	}
+	return record
+}
+
+func TestSign(t *testing.T) {
+	mac := knownMAC(t)
+	_, request := testMessage(t, testTime, mac)
+	response := []byte{0x12, 0x34, 0x84, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	response = bytes.Add(response, types.Encode("example.com"))
+	response = bytes.Add(response, []byte{0, 1, 0, 1})
+	record := signAndParse(t, response, request, 0)
+	// RFC 8945, section 4.3.3: the MAC of the request, then the
+	// response, then the TSIG variables
+	h := testKey.newHash()
+	h.Write([]byte{0, 32})
+	h.Write(mac)
+	h.Write(response)
+	h.Write(variables(record))
+	if !bytes.Equal(record.MAC, h.Sum()) || record.Error != 0 {
+		t.Errorf("Wrong MAC in the response: %x", record.MAC)
+	}
+	// BADTIME: signed, with the time of the request and ours in
+	// Other (RFC 8945, section 5.2.3)
+	record = signAndParse(t, response, request, types.BADTIME)
+	if record.Error != types.BADTIME || record.TimeSigned != testTime ||
+		len(record.Other) != 6 || len(record.MAC) != 32 {
+		t.Errorf("Wrong BADTIME response: %v", record)
+	}
+	// BADSIG: not signed
+	record = signAndParse(t, response, request, types.BADSIG)
+	if record.Error != types.BADSIG || len(record.MAC) != 0 {
+		t.Errorf("Wrong BADSIG response: %v", record)
+	}
+}
+
+type truncationTest struct {
+	algorithm string
+	macsize   int
+	ok        bool
+}
+
+// RFC 8945, section 5.2.2.1: at least half of the hash and 10 bytes,
+// at most the hash
+var truncationTests = []truncationTest{
+	truncationTest{HMACSHA256, 32, true},
+	truncationTest{HMACSHA256, 16, true},
+	truncationTest{HMACSHA256, 15, false},
+	truncationTest{HMACSHA256, 33, false},
+	truncationTest{HMACSHA512, 32, true},
+	truncationTest{HMACSHA512, 31, false},
+	truncationTest{HMACSHA512, 64, true},
+	truncationTest{"hmac-unknown", 1, true}, // BADKEY later
+}
+
+func TestTruncatedMAC(t *testing.T) {
+	for _, test := range truncationTests {
+		rdata := testRdata(test.algorithm, testTime, make([]byte, test.macsize))
+		_, ok := Parse(testKeyName, rdata)
+		if ok != test.ok {
+			t.Errorf("%s with a MAC of %d bytes: %v instead of %v", test.algorithm,
+				test.macsize, ok, test.ok)
+		}
+	}
+}
+
+// The names are copied in the reply, they must be encodable
+func TestInvalidNames(t *testing.T) {
+	rdata := testRdata(HMACSHA256, testTime, make([]byte, 32))
+	if _, ok := Parse("key..example.com", rdata); ok {
+		t.Errorf("Invalid key name accepted")
+	}
+	rdata[1] = '.' // "h.ac-sha256"
+	if _, ok := Parse(testKeyName, rdata); ok {
+		t.Errorf("Algorithm with a dot in a label accepted")
+	}
+}
@@ -8,9 +8,7 @@ package types
 
 import (
 	"net"
-	"strings"
 	"fmt"
-	"bytes"
 	"encoding/binary"
 )
 
@@ -18,9 +16,18 @@ import (
 // front-end and its responder (the back-end). So, only a part of DNS
 // info can be represented.
 type DNSresponse struct {
-	Responsecode uint
-	Ansection    []RR
-	// TODO: allow to have other sections?
+	Responsecode  uint
+	Authoritative bool // The AA bit
+	Ansection     []RR
+	Nssection     []RR // Authority section
+	Arsection     []RR // Additional section
+	// The response depends only on the question (name, type, class
+	// and DO bit), so the front-end may cache it
+	Cacheable bool
+	// The response depends on the EcsAddress of the query, for all the
+	// addresses in this prefix length (RFC 7871, section 7.2.1)
+	EcsUsed  bool
+	EcsScope uint8
 }
 // TODO: provides a String() method
 
@@ -33,6 +40,15 @@ type DNSquery struct {
 	Qclass     uint16
 	Qtype      uint16
 	BufferSize uint16
+	Dnssec     bool // The DO bit, RFC 3225
+	Id         uint16
+	Flags      uint16 // The second 16 bits of the header, as received
+	Edns       bool
+	Nsid       bool   // RFC 5001
+	Ecs        bool   // EDNS Client Subnet, RFC 7871
+	EcsAddress net.IP // nil if there is no valid ECS option
+	EcsSource  uint8  // The source prefix length of ECS
+	View       string // Chosen by the front-end, "" if there are no views
 }
 // TODO: provides a String() method
 
@@ -47,6 +63,7 @@ type DNSheader struct {
 // described in RFC 1035, section 4.1. So, it is a bit long
 type DNSpacket struct {
 	Id                                 uint16
+	Flags                              uint16 // As received, the individual flags are below
 	Opcode                             uint
 	Rcode                              uint
 	Edns                               bool
@@ -56,9 +73,27 @@ type DNSpacket struct {
 	// of the following arrays, instead?
 	Qsection  []Qentry
 	Ansection []RR // Answer section
+	Nssection []RR // Authority section
 	Arsection []RR // Additional section
-	// TODO: other sections
-	Nsid bool // RFC 5001
+	Nsid      bool // RFC 5001
+	Ecs       bool // RFC 7871
+	Dnssec    bool // The DO bit, RFC 3225
+	// The ECS option (EcsAddress is nil if it is invalid) and, in a
+	// response, the scope to send back if EcsReply is set
+	EcsFamily  uint16
+	EcsSource  uint8
+	EcsAddress net.IP
+	EcsScope   uint8
+	EcsReply   bool
+	Truncated  bool
+	// RFC 8945. nil if the message is not signed. In a response, it is
+	// the TSIG record of the request.
+	Tsig      *TSIGrecord
+	TsigError uint16 // For responses: the TSIG error to send back
+	// For responses: if not nil, the response already serialized, from
+	// the cache. Else, if not empty, the key to store it in the cache.
+	Wire     []byte
+	CacheKey string
 }
 
 func (packet DNSpacket) String() string {
@@ -81,6 +116,20 @@ type RR struct {
 	Data []byte
 }
 
+// TSIG pseudo-record, RFC 8945, section 4.2. Always the last record of
+// the additional section.
+type TSIGrecord struct {
+	Name       string // Of the key
+	Algorithm  string
+	TimeSigned uint64 // Only 48 bits are used
+	Fudge      uint16
+	MAC        []byte
+	OriginalId uint16
+	Error      uint16
+	Other      []byte
+	Start      int // Offset of the record in the received message
+}
+
 type SOArecord struct {
 	Mname                  string
 	Rname                  string
@@ -97,36 +146,98 @@ const (
 	NXDOMAIN = 3
 	NOTIMPL  = 4
 	REFUSED  = 5
+	NOTAUTH  = 9
+
+	// TSIG errors, RFC 8945, section 3
+	BADSIG   = 16
+	BADKEY   = 17
+	BADTIME  = 18
+	BADTRUNC = 22
 
 	// Classes
-	IN = 1
-	CS = 2
-	CH = 3
-	HS = 4
+	IN       = 1
+	CS       = 2
+	CH       = 3
+	HS       = 4
+	ANYCLASS = 255
 
 	// Types
-	A     = 1
-	NS    = 2
-	SOA   = 6
-	PTR   = 12
-	HINFO = 13
-	MX    = 15
-	TXT   = 16
-	AAAA  = 28
-	OPT   = 41
-	ALL   = 255
+	A          = 1
+	NS         = 2
+	CNAME      = 5
+	SOA        = 6
+	PTR        = 12
+	HINFO      = 13
+	MX         = 15
+	TXT        = 16
+	AAAA       = 28
+	SRV        = 33
+	OPT        = 41
+	DS         = 43
+	RRSIG      = 46
+	NSEC       = 47
+	DNSKEY     = 48
+	NSEC3      = 50
+	NSEC3PARAM = 51
+	NXNAME     = 128 // RFC 9824
+	TSIG       = 250
+	IXFR       = 251
+	AXFR       = 252
+	ALL        = 255
 
 	// Opcodes
 	STDQUERY = 0
 	IQUERY   = 1
 	STATUS   = 2
+	NOTIFY   = 4 // RFC 1996
+	UPDATE   = 5 // RFC 2136
 
 	// EDNS Option codes
-	NSID = 3
+	NSID         = 3
+	CLIENTSUBNET = 8 // RFC 7871
+
+	// Flags of the header, RFC 1035, section 4.1.1, and RFC 4035,
+	// section 3.2
+	FLAGRD = 0x0100
+	FLAGAD = 0x0020
+	FLAGCD = 0x0010
 )
 
+var typeNames = map[uint16]string{
+	A: "A", NS: "NS", CNAME: "CNAME", SOA: "SOA", PTR: "PTR",
+	HINFO: "HINFO", MX: "MX", TXT: "TXT", AAAA: "AAAA", SRV: "SRV",
+	OPT: "OPT", DS: "DS", RRSIG: "RRSIG", NSEC: "NSEC",
+	DNSKEY: "DNSKEY", NSEC3: "NSEC3", NSEC3PARAM: "NSEC3PARAM",
+	TSIG: "TSIG", ALL: "ANY",
+}
+
 // Various utility functions
 
+// The mnemonic of a type, or TYPEnnn (RFC 3597, section 5) if we do
+// not know it
+func TypeName(rrtype uint16) string {
+	name, known := typeNames[rrtype]
+	if known {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", rrtype)
+}
+
+var rcodeNames = map[uint]string{
+	NOERROR: "NOERROR", FORMERR: "FORMERR", SERVFAIL: "SERVFAIL",
+	NXDOMAIN: "NXDOMAIN", NOTIMPL: "NOTIMPL", REFUSED: "REFUSED",
+	NOTAUTH: "NOTAUTH",
+}
+
+// The mnemonic of a response code, or RCODEnnn
+func RcodeName(rcode uint) string {
+	name, known := rcodeNames[rcode]
+	if known {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
 // Converts a string to the wire format {length, data}
 func ToTXT(s string) []byte {
 	result := make([]byte, 1+len(s))
@@ -137,58 +248,182 @@ func ToTXT(s string) []byte {
 	return result
 }
 
-// Encodes a FQDN in wire-format (for each label, length+data)
+// The functions Append* write at the end of dst and return the
+// extended slice, like bytes.Add. If dst has enough capacity, they do
+// not allocate anything, so a caller can reuse the same buffer for
+// every message.
+
+// Returns dst extended by n bytes, reallocating it only if its
+// capacity is too small
+func extend(dst []byte, n int) []byte {
+	if len(dst)+n > cap(dst) {
+		newdst := make([]byte, len(dst), 2*cap(dst)+n)
+		copy(newdst, dst)
+		dst = newdst
+	}
+	return dst[0 : len(dst)+n]
+}
+
+func AppendShort(dst []byte, i uint16) []byte {
+	dst = extend(dst, 2)
+	binary.BigEndian.PutUint16(dst[len(dst)-2:], i)
+	return dst
+}
+
+func AppendLong(dst []byte, i uint32) []byte {
+	dst = extend(dst, 4)
+	binary.BigEndian.PutUint32(dst[len(dst)-4:], i)
+	return dst
+}
+
+// The length of a FQDN in wire-format
+func NameLength(name string) int {
+	if name == "." || name == "" { // The root is a special case. See issue #4
+		return 1
+	}
+	return len(name) + 2 // The first length byte and the final null byte
+}
+
+// Tells if the name can be encoded: no empty label (except for the
+// root, "." or "") and no label longer than 63 bytes (RFC 1035,
+// section 2.3.4), 255 bytes at most in wire-format
+func ValidName(name string) bool {
+	if name == "." || name == "" {
+		return true
+	}
+	if NameLength(name) > 255 {
+		return false
+	}
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i == len(name) || name[i] == '.' {
+			if i == start || i-start > 63 {
+				return false
+			}
+			start = i + 1
+		}
+	}
+	return true
+}
+
+// Appends a FQDN in wire-format (for each label, length+data). If the
+// name is not valid (see ValidName), dst is returned unchanged, with
+// false.
 // TODO: see packDomainName in net/dnsmsg.go.
+func AppendName(dst []byte, name string) ([]byte, bool) {
+	if !ValidName(name) {
+		return dst, false
+	}
+	start := len(dst)
+	dst = extend(dst, NameLength(name))
+	if name == "." || name == "" {
+		dst[start] = 0
+		return dst, true
+	}
+	// Each dot becomes the length of the following label
+	lengthpos := start
+	for i := 0; i < len(name); i++ {
+		if name[i] == '.' {
+			dst[lengthpos] = uint8(start + 1 + i - lengthpos - 1)
+			lengthpos = start + 1 + i
+		} else {
+			dst[start+1+i] = name[i]
+		}
+	}
+	dst[lengthpos] = uint8(start + 1 + len(name) - lengthpos - 1)
+	dst[len(dst)-1] = 0 // Domain names end in a null byte for the root
+	return dst, true
+}
+
+// The length of a resource record in wire-format
+func RRLength(rr RR) int {
+	return NameLength(rr.Name) + 10 + len(rr.Data)
+}
+
+// Appends a resource record in wire-format, without compression. Like
+// AppendName, returns false if the owner name is not valid.
+func AppendRR(dst []byte, rr RR) ([]byte, bool) {
+	dst, ok := AppendName(dst, rr.Name)
+	if !ok {
+		return dst, false
+	}
+	dst = AppendShort(dst, rr.Type)
+	dst = AppendShort(dst, rr.Class)
+	dst = AppendLong(dst, rr.TTL)
+	dst = AppendShort(dst, uint16(len(rr.Data)))
+	dst = extend(dst, len(rr.Data))
+	copy(dst[len(dst)-len(rr.Data):], rr.Data)
+	return dst, true
+}
+
+// AppendName for the names which must be valid (they come from the
+// wire, or have been checked with ValidName): it is a programming
+// error otherwise.
+func mustAppendName(dst []byte, name string) []byte {
+	result, ok := AppendName(dst, name)
+	if !ok {
+		panic(fmt.Sprintf("Invalid domain name \"%s\"", name))
+	}
+	return result
+}
+
+// Encodes a FQDN in wire-format. Same restriction as mustAppendName.
 func Encode(name string) []byte {
-	var (
-		totalresult []byte
-	)
-	labels := make([]string, 0)
-	if name != "." { // The root is a special case. See issue #4
-		labels = strings.Split(name, ".", -1)
-	}
-	totallength := 0
-	totalresult = make([]byte, 256) // TODO what a waste
-	for _, label := range labels {
-		result := make([]byte, 1+len(label))
-		result[0] = uint8(len(label))
-		for i := 0; i < len(label); i++ {
-			result[i+1] = label[i]
+	return mustAppendName(make([]byte, 0, NameLength(name)), name)
+}
+
+// Decodes a FQDN in wire-format, the reverse of Encode. Compression is
+// not supported. Returns the name and the number of bytes used. The
+// only allocation is the resulting string. Labels which contain a dot
+// are refused, since the name could not be encoded again: every
+// decoded name is valid for ValidName.
+func Decode(data []byte) (name string, length int, ok bool) {
+	var text [255]byte // RFC 1035, section 3.1: 255 bytes at most
+	textlength := 0
+	for {
+		if length >= len(data) {
+			return "", 0, false
 		}
-		for i := 0; i < 1+len(label); i++ {
-			totalresult[totallength+i] = result[i]
+		labelsize := int(data[length])
+		length++
+		if labelsize == 0 {
+			break
 		}
-		totallength = totallength + int(result[0]) + 1
+		if labelsize > 63 || length+labelsize > len(data) ||
+			textlength+labelsize+1 > len(text) {
+			return "", 0, false
+		}
+		if textlength > 0 {
+			text[textlength] = '.'
+			textlength++
+		}
+		for _, c := range data[length : length+labelsize] {
+			if c == '.' {
+				return "", 0, false
+			}
+			text[textlength] = c
+			textlength++
+		}
+		length += labelsize
 	}
-	totalresult[totallength] = 0 // Domain names end in a null byte for the root
-	totallength++
-	return totalresult[0:totallength]
+	if textlength == 0 {
+		return ".", length, true
+	}
+	if length > 255 {
+		return "", 0, false
+	}
+	return string(text[0:textlength]), length, true
 }
 
 func EncodeSOA(soa SOArecord) []byte {
-	var (
-		result []byte
-		temp32 []byte
-	)
-	mname := Encode(soa.Mname)
-	length := len(mname)
-	rname := Encode(soa.Rname)
-	length = length + len(rname)
-	length = length + (5 * 4) // Five 32-bits counter at the end
-	/* "It's probably cleaner to write to a bytes.Buffer than to
-	repeatedly call bytes.Add." Russ Cox, go-nuts ML */
-	result = bytes.Add(result, mname)
-	result = bytes.Add(result, rname)
-	temp32 = make([]byte, 4)
-	binary.BigEndian.PutUint32(temp32, soa.Serial)
-	result = bytes.Add(result, temp32)
-	binary.BigEndian.PutUint32(temp32, soa.Refresh)
-	result = bytes.Add(result, temp32)
-	binary.BigEndian.PutUint32(temp32, soa.Retry)
-	result = bytes.Add(result, temp32)
-	binary.BigEndian.PutUint32(temp32, soa.Expire)
-	result = bytes.Add(result, temp32)
-	binary.BigEndian.PutUint32(temp32, soa.Minimum)
-	result = bytes.Add(result, temp32)
-	return result[0:length]
+	result := make([]byte, 0, NameLength(soa.Mname)+NameLength(soa.Rname)+5*4)
+	result = mustAppendName(result, soa.Mname)
+	result = mustAppendName(result, soa.Rname)
+	// Five 32-bits counter at the end
+	result = AppendLong(result, soa.Serial)
+	result = AppendLong(result, soa.Refresh)
+	result = AppendLong(result, soa.Retry)
+	result = AppendLong(result, soa.Expire)
+	result = AppendLong(result, soa.Minimum)
+	return result
 }
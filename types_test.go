@@ -0,0 +1,122 @@
+/* Tests of the encoding of domain names.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package types
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type nameTest struct {
+	name    string
+	encoded []byte // nil if the name is invalid
+}
+
+var label63 = strings.Repeat("a", 63)
+
+var nameTests = []nameTest{
+	nameTest{".", []byte{0}},
+	nameTest{"", []byte{0}}, // The root, too, not two null bytes
+	nameTest{"net", []byte{3, 'n', 'e', 't', 0}},
+	nameTest{"www.example.net", bytes.Add([]byte{3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e'},
+		[]byte{3, 'n', 'e', 't', 0})},
+	nameTest{label63 + ".net", bytes.Add(bytes.Add([]byte{63}, []byte(label63)),
+		[]byte{3, 'n', 'e', 't', 0})},
+	nameTest{label63 + "a.net", nil}, // 64 bytes
+	nameTest{"www..net", nil},
+	nameTest{".net", nil},
+	nameTest{"www.", nil},
+	// 4*63 bytes + 4 dots + 3 = 259 bytes
+	nameTest{strings.Repeat(label63+".", 4) + "net", nil},
+}
+
+func TestAppendName(t *testing.T) {
+	for _, test := range nameTests {
+		prefix := []byte{42}
+		result, ok := AppendName(prefix, test.name)
+		if test.encoded == nil {
+			if ok || len(result) != 1 {
+				t.Errorf("\"%s\" accepted as %v", test.name, result)
+			}
+			if ValidName(test.name) {
+				t.Errorf("\"%s\" is valid for ValidName", test.name)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("\"%s\" refused", test.name)
+			continue
+		}
+		if !bytes.Equal(result[1:], test.encoded) || result[0] != 42 {
+			t.Errorf("\"%s\" encoded as %v instead of %v", test.name, result[1:], test.encoded)
+		}
+		if NameLength(test.name) != len(test.encoded) {
+			t.Errorf("NameLength(\"%s\") is %d instead of %d", test.name,
+				NameLength(test.name), len(test.encoded))
+		}
+		decoded, length, ok := Decode(test.encoded)
+		expected := test.name
+		if expected == "" {
+			expected = "."
+		}
+		if !ok || decoded != expected || length != len(test.encoded) {
+			t.Errorf("\"%s\" decoded as \"%s\" (%d bytes)", test.name, decoded, length)
+		}
+	}
+}
+
+// Wire-format names which Decode must refuse
+var badWireNames = [][]byte{
+	[]byte{1, 'a', '.', 1, 'b', 0}, // Would be "a..b"
+	[]byte{1, '.', 0},              // Would be "."
+	[]byte{3, 'n', 'e', 't'},       // No final null byte
+	[]byte{64},                     // Label too long
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, wire := range badWireNames {
+		name, _, ok := Decode(wire)
+		if ok {
+			t.Errorf("%v decoded as \"%s\"", wire, name)
+		}
+	}
+	// 4 labels of 63 bytes: 257 bytes in wire-format
+	label := bytes.Add([]byte{63}, []byte(label63))
+	wire := bytes.Add(bytes.Add(label, label), bytes.Add(label, label))
+	wire = bytes.Add(wire, []byte{0})
+	if _, _, ok := Decode(wire); ok {
+		t.Errorf("Name of %d bytes decoded", len(wire))
+	}
+	// The decoded names can always be encoded again
+	wire = []byte{1, 'a', 1, 'b', 0}
+	name, _, ok := Decode(wire)
+	if !ok || !bytes.Equal(Encode(name), wire) {
+		t.Errorf("%v decoded as \"%s\"", wire, name)
+	}
+}
+
+func TestAppendRR(t *testing.T) {
+	rr := RR{Name: "www.example.net", Type: A, Class: IN, TTL: 3600, Data: []byte{192, 0, 2, 1}}
+	result, ok := AppendRR(nil, rr)
+	if !ok || len(result) != RRLength(rr) {
+		t.Errorf("RR encoded in %d bytes instead of %d", len(result), RRLength(rr))
+	}
+	rr.Name = label63 + "a.example.net"
+	_, ok = AppendRR(nil, rr)
+	if ok {
+		t.Errorf("RR with a label of 64 bytes accepted")
+	}
+}
+
+func BenchmarkAppendRR(b *testing.B) {
+	b.ReportAllocs()
+	rr := RR{Name: "www.example.net", Type: A, Class: IN, TTL: 3600, Data: []byte{192, 0, 2, 1}}
+	buffer := make([]byte, 0, 512)
+	for i := 0; i < b.N; i++ {
+		AppendRR(buffer, rr)
+	}
+}
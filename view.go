@@ -0,0 +1,113 @@
+/* Views (split-horizon DNS): the front-end chooses a view for each
+   query, from the client address, the local address or the TSIG key,
+   and gives its name to the responder, which can serve different data
+   in each view.
+
+   The file has one view per line, in order, the first matching one is
+   chosen:
+
+   view NAME [client PREFIX,...] [local PREFIX,...] [key KEYNAME]
+
+   All the criteria of a view must match. A view without criteria
+   matches everything.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package view
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"./prefix"
+)
+
+type View struct {
+	Name    string
+	clients []prefix.Prefix // nil if any client matches
+	locals  []prefix.Prefix // nil if any local address matches
+	key     string          // "" if the query does not need to be signed
+}
+
+func canonical(name string) string {
+	name = strings.ToLower(name)
+	if len(name) > 1 && name[len(name)-1] == '.' {
+		name = name[0 : len(name)-1]
+	}
+	return name
+}
+
+func Read(filename string) (views []*View, error os.Error) {
+	content, error := ioutil.ReadFile(filename)
+	if error != nil {
+		return nil, error
+	}
+	lines := strings.Split(string(content), "\n", -1)
+	views = make([]*View, 0, len(lines))
+	names := make(map[string]bool)
+	for linenum, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		where := fmt.Sprintf("%s:%d", filename, linenum+1)
+		if fields[0] != "view" || len(fields) < 2 || len(fields)%2 != 0 {
+			return nil, os.NewError(where + ": \"view NAME\" expected, followed by criteria and their values")
+		}
+		if names[fields[1]] {
+			return nil, os.NewError(fmt.Sprintf("%s: duplicate view %s", where, fields[1]))
+		}
+		names[fields[1]] = true
+		view := &View{Name: fields[1]}
+		for i := 2; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "client":
+				view.clients, error = prefix.ParseList(fields[i+1])
+			case "local":
+				view.locals, error = prefix.ParseList(fields[i+1])
+			case "key":
+				view.key = canonical(fields[i+1])
+			default:
+				return nil, os.NewError(fmt.Sprintf("%s: unknown criterion %s", where, fields[i]))
+			}
+			if error != nil {
+				return nil, os.NewError(fmt.Sprintf("%s: %s", where, error))
+			}
+		}
+		views = views[0 : len(views)+1]
+		views[len(views)-1] = view
+	}
+	return views, nil
+}
+
+// Tells if one of the views has criteria on the local address
+func UsesLocal(views []*View) bool {
+	for _, view := range views {
+		if view.locals != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first view which matches. key is the name of the TSIG
+// key of the query ("" if it is not signed).
+func Select(views []*View, client net.IP, local net.IP, key string) (name string, found bool) {
+	for _, view := range views {
+		if view.clients != nil && !prefix.Match(view.clients, client) {
+			continue
+		}
+		if view.locals != nil && !prefix.Match(view.locals, local) {
+			continue
+		}
+		if view.key != "" && view.key != key {
+			continue
+		}
+		return view.Name, true
+	}
+	return "", false
+}
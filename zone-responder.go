@@ -0,0 +1,529 @@
+/* A name server with data, read from a zone file, and optionally
+signed on the fly with DNSSEC.
+
+Denial of existence is done with the "compact" method of RFC 9824
+(NXDOMAIN becomes NOERROR with a NSEC record having the NXNAME
+type), which is the simplest with online signing since there is no
+need to know the previous and next names.
+
+The zone file may also be signed beforehand (for instance with
+dnssec-signzone or ldns-signzone), in which case its RRSIG and NSEC
+or NSEC3 records are served as they are and no key is needed.
+
+Wildcards are expanded (RFC 4592), with, for the zones signed
+beforehand, the proofs of RFC 4035, section 3.1.3.3 and 3.1.3.4 (or
+RFC 5155, section 7.2.5 and 7.2.6, for NSEC3).
+
+Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+
+ Example of use:
+
+ grong -servername "ns1.example.net" -- -zonefile example.net.zone -ksk Kexample.net.+013+12345.private -zsk Kexample.net.+013+54321.private
+
+ grong -servername "ns1.example.net" -- -zonefile example.net.zone.signed
+
+ With views (-views option of the server), each view may have its
+ own zone file, the other views get the one of -zonefile:
+
+ grong -views views.conf -- -zonefile external.zone -viewzonefiles internal=internal.zone
+
+*/
+
+package responder
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"./dnssec"
+	"./types"
+	"./zonefile"
+	"./myflag"
+)
+
+const defaultTTL = 3600
+
+// The NSEC3 parameters of a zone signed beforehand, from its
+// NSEC3PARAM record
+type nsec3Parameters struct {
+	salt       []byte
+	iterations uint16
+}
+
+// The data served to a view (or to every query, if there are no
+// views)
+type zoneData struct {
+	zone   *zonefile.Zone
+	signer *dnssec.Signer   // nil if the zone is not signed on the fly
+	nsec3  *nsec3Parameters // nil if the zone uses NSEC
+}
+
+// Indexed by the name of the view, "" for the default data, from
+// -zonefile. Replaced as a whole by Reload, under servedMutex.
+var (
+	served      map[string]*zoneData
+	servedMutex sync.RWMutex
+)
+
+func concat(section []types.RR, rrs []types.RR) []types.RR {
+	result := make([]types.RR, len(section)+len(rrs))
+	copy(result, section)
+	copy(result[len(section):], rrs)
+	return result
+}
+
+// Adds the RRset to the section, with its signature if needed
+func (data *zoneData) addRRset(section []types.RR, rrset []types.RR, secure bool) []types.RR {
+	section = concat(section, rrset)
+	if secure {
+		if data.signer == nil {
+			section = concat(section, data.zone.Signatures(rrset[0].Name, rrset[0].Type))
+		} else {
+			section = concat(section, []types.RR{data.signer.Sign(rrset, true)})
+		}
+	}
+	return section
+}
+
+// A copy of the records, with another owner name
+func rename(rrs []types.RR, name string) []types.RR {
+	result := make([]types.RR, len(rrs))
+	copy(result, rrs)
+	for i := range result {
+		result[i].Name = name
+	}
+	return result
+}
+
+// Adds the RRset of the answer to the section. If it comes from a
+// wildcard, the records are synthesized with the query name (RFC
+// 4592, section 3.3.1). A zone signed beforehand has signatures for
+// the wildcard, whose labels field tells validators about the
+// expansion. Signing on the fly, we sign as if the name existed, but
+// without keeping the signature, since every name would get one.
+func (data *zoneData) addAnswer(section []types.RR, rrset []types.RR, qname string, secure bool) []types.RR {
+	source := rrset[0].Name
+	if source == qname {
+		return data.addRRset(section, rrset, secure)
+	}
+	synthesized := rename(rrset, qname)
+	section = concat(section, synthesized)
+	if secure && data.signer == nil {
+		section = concat(section, rename(data.zone.Signatures(source, rrset[0].Type), qname))
+	} else if secure {
+		section = concat(section, []types.RR{data.signer.Sign(synthesized, false)})
+	}
+	return section
+}
+
+// Adds the denial record(s) of this type at this name, with their
+// signatures, unless they are already in the section
+func (data *zoneData) addDenial(section []types.RR, name string, rrtype uint16) []types.RR {
+	for _, rr := range section {
+		if rr.Name == name && rr.Type == rrtype {
+			return section
+		}
+	}
+	rrset := data.zone.FindDenial(name, rrtype)
+	if rrset == nil {
+		return section
+	}
+	return data.addRRset(section, rrset, true)
+}
+
+func (data *zoneData) hashed(name string) string {
+	return dnssec.EncodeBase32hex(dnssec.NSEC3Hash(name, data.nsec3.salt, data.nsec3.iterations)) +
+		"." + data.zone.Origin
+}
+
+func (data *zoneData) denialType() uint16 {
+	if data.nsec3 == nil {
+		return types.NSEC
+	}
+	return types.NSEC3
+}
+
+// The name of the NSEC or NSEC3 record which covers (or matches) name
+func (data *zoneData) covering(name string) string {
+	sorted := data.zone.Sorted(data.denialType())
+	if len(sorted) == 0 {
+		return ""
+	}
+	if data.nsec3 == nil {
+		return zonefile.Predecessor(sorted, name)
+	}
+	return zonefile.Predecessor(sorted, data.hashed(name))
+}
+
+// Tells if the name has its own NSEC or NSEC3 record
+func (data *zoneData) matching(name string) bool {
+	if data.nsec3 != nil {
+		name = data.hashed(name)
+	}
+	return data.zone.FindDenial(name, data.denialType()) != nil
+}
+
+func (data *zoneData) encloses(name string) bool {
+	if data.nsec3 == nil { // Empty non-terminals have no NSEC
+		_, exists := data.zone.Find(name)
+		return exists
+	}
+	return data.matching(name)
+}
+
+// The closest encloser of a name which does not exist, and the next
+// closer name, its child on the way to the name (RFC 5155, section
+// 1.3)
+func (data *zoneData) encloser(qname string) (encloser string, nextcloser string) {
+	nextcloser = qname
+	encloser = zonefile.Parent(qname)
+	for encloser != data.zone.Origin && !data.encloses(encloser) {
+		nextcloser = encloser
+		encloser = zonefile.Parent(encloser)
+	}
+	return
+}
+
+func wildcardOf(encloser string) string {
+	if encloser == "." {
+		return "*"
+	}
+	return "*." + encloser
+}
+
+// The wildcard which matches a name which does not exist, the one
+// under its closest encloser (RFC 4592, section 3.3.1). "" if there
+// is none.
+func (data *zoneData) wildcard(qname string) string {
+	encloser, _ := data.encloser(qname)
+	_, exists := data.zone.Find(wildcardOf(encloser))
+	if !exists {
+		return ""
+	}
+	return wildcardOf(encloser)
+}
+
+// The closest encloser proof of RFC 5155, section 7.2.1: the NSEC3
+// matching the closest encloser and the one covering the next closer
+// name. With NSEC, the record covering the name is enough. Returns
+// also the closest encloser.
+func (data *zoneData) closestEncloser(section []types.RR, qname string) ([]types.RR, string) {
+	encloser, nextcloser := data.encloser(qname)
+	if data.nsec3 == nil {
+		return data.addDenial(section, data.covering(qname), types.NSEC), encloser
+	}
+	section = data.addDenial(section, data.hashed(encloser), types.NSEC3)
+	section = data.addDenial(section, data.covering(nextcloser), types.NSEC3)
+	return section, encloser
+}
+
+// The proof of denial of a zone signed beforehand, with its NSEC or
+// NSEC3 chain: RFC 4035, section 3.1.3, and RFC 5155, section 7.2
+func (data *zoneData) denial(section []types.RR, qname string, nxdomain bool) []types.RR {
+	if !nxdomain && data.matching(qname) {
+		if data.nsec3 == nil {
+			return data.addDenial(section, qname, types.NSEC)
+		}
+		return data.addDenial(section, data.hashed(qname), types.NSEC3)
+	}
+	// Name error, or name without a NSEC3 record (an insecure
+	// delegation, with opt-out, RFC 5155, section 7.2.4)
+	section, encloser := data.closestEncloser(section, qname)
+	if nxdomain { // There is no wildcard, either
+		section = data.addDenial(section, data.covering(wildcardOf(encloser)), data.denialType())
+	} else if _, exists := data.zone.Find(qname); !exists {
+		// The name comes from a wildcard, which does not have the
+		// type: RFC 4035, section 3.1.3.4, and RFC 5155, section
+		// 7.2.5
+		wildcard := wildcardOf(encloser)
+		if data.nsec3 != nil {
+			wildcard = data.hashed(wildcard)
+		}
+		section = data.addDenial(section, wildcard, data.denialType())
+	}
+	return section
+}
+
+// The proof that the query name does not exist, for an answer
+// synthesized from a wildcard of a zone signed beforehand: RFC 4035,
+// section 3.1.3.3, and RFC 5155, section 7.2.6
+func (data *zoneData) wildcardProof(qname string) []types.RR {
+	if data.nsec3 == nil {
+		return data.addDenial(nil, data.covering(qname), types.NSEC)
+	}
+	_, nextcloser := data.encloser(qname)
+	return data.addDenial(nil, data.covering(nextcloser), types.NSEC3)
+}
+
+// The authority section of negative answers: the SOA and, if secure,
+// the NSEC record proving that the types do not exist at this name.
+func (data *zoneData) negative(qname string, present []uint16, secure bool, nxdomain bool) (section []types.RR) {
+	soa := data.zone.SOA
+	section = []types.RR{soa}
+	section[0].TTL = data.zone.NegativeTTL()
+	if secure && data.signer == nil {
+		soasigs := data.zone.Signatures(soa.Name, types.SOA)
+		for i := range soasigs {
+			soasigs[i].TTL = data.zone.NegativeTTL()
+		}
+		section = data.denial(concat(section, soasigs), qname, nxdomain)
+	} else if secure {
+		soasig := data.signer.Sign([]types.RR{soa}, true)
+		soasig.TTL = data.zone.NegativeTTL()
+		nsec := dnssec.CompactNSEC(qname, present, data.zone.NegativeTTL())
+		section = concat(section, []types.RR{soasig, nsec, data.signer.Sign([]types.RR{nsec}, false)})
+	}
+	return
+}
+
+func presentTypes(rrsets map[uint16][]types.RR) []uint16 {
+	result := make([]uint16, 0, len(rrsets))
+	for rrtype := range rrsets {
+		result = result[0 : len(result)+1]
+		result[len(result)-1] = rrtype
+	}
+	return result
+}
+
+// The addresses of the name servers which are under the delegation
+// (glue)
+func (data *zoneData) glue(nsset []types.RR, cut string) (section []types.RR) {
+	for _, ns := range nsset {
+		target, _, ok := types.Decode(ns.Data)
+		if !ok || !data.zone.Contains(target) {
+			continue
+		}
+		if target != cut && !strings.HasSuffix(target, "."+cut) {
+			continue
+		}
+		rrsets, _ := data.zone.Find(target)
+		section = concat(section, rrsets[types.A])
+		section = concat(section, rrsets[types.AAAA])
+	}
+	return
+}
+
+func (data *zoneData) referral(cut string, secure bool) (result types.DNSresponse) {
+	result.Responsecode = types.NOERROR
+	result.Authoritative = false
+	result.Cacheable = true
+	rrsets, _ := data.zone.Find(cut)
+	result.Nssection = rrsets[types.NS]
+	if secure && rrsets[types.DS] != nil { // Only possible when signed beforehand
+		result.Nssection = data.addRRset(result.Nssection, rrsets[types.DS], secure)
+	} else if secure && data.signer == nil {
+		result.Nssection = data.denial(result.Nssection, cut, false)
+	} else if secure {
+		// Proof that there is no DS, the delegation is insecure
+		nsec := dnssec.CompactNSEC(cut, presentTypes(rrsets), data.zone.NegativeTTL())
+		result.Nssection = concat(result.Nssection,
+			[]types.RR{nsec, data.signer.Sign([]types.RR{nsec}, false)})
+	}
+	result.Arsection = data.glue(rrsets[types.NS], cut)
+	return
+}
+
+func (data *zoneData) respond(query types.DNSquery) (result types.DNSresponse) {
+	result.Cacheable = true
+	if query.Qclass != types.IN || !data.zone.Contains(query.Qname) {
+		result.Responsecode = types.REFUSED
+		return
+	}
+	secure := query.Dnssec && (data.signer != nil || data.zone.Signed())
+	cut, delegated := data.zone.Delegation(query.Qname)
+	if delegated && !(query.Qname == cut && query.Qtype == types.DS) {
+		return data.referral(cut, secure)
+	}
+	result.Authoritative = true
+	rrsets, exists := data.zone.Find(query.Qname)
+	wildcard := ""
+	if !exists {
+		wildcard = data.wildcard(query.Qname)
+		if wildcard != "" {
+			rrsets, exists = data.zone.Find(wildcard)
+		}
+	}
+	if !exists {
+		if secure && data.signer != nil {
+			// Compact denial of existence, RFC 9824, section 3
+			result.Responsecode = types.NOERROR
+			result.Nssection = data.negative(query.Qname, []uint16{types.NXNAME}, secure, false)
+		} else {
+			result.Responsecode = types.NXDOMAIN
+			result.Nssection = data.negative(query.Qname, nil, secure, true)
+		}
+		return
+	}
+	result.Responsecode = types.NOERROR
+	switch {
+	case query.Qtype == types.ALL && len(rrsets) > 0:
+		for rrtype, rrset := range rrsets {
+			if rrtype != types.RRSIG || !secure { // Signatures come with their RRset
+				result.Ansection = data.addAnswer(result.Ansection, rrset, query.Qname, secure)
+			}
+		}
+	case rrsets[query.Qtype] != nil:
+		result.Ansection = data.addAnswer(nil, rrsets[query.Qtype], query.Qname, secure)
+	case rrsets[types.CNAME] != nil:
+		result.Ansection = data.addAnswer(nil, rrsets[types.CNAME], query.Qname, secure)
+	default:
+		result.Nssection = data.negative(query.Qname, presentTypes(rrsets), secure, false)
+		return
+	}
+	if wildcard != "" && secure && data.signer == nil {
+		result.Nssection = data.wildcardProof(query.Qname)
+	}
+	return
+}
+
+func Respond(query types.DNSquery, config map[string]interface{}) types.DNSresponse {
+	servedMutex.RLock()
+	data, exists := served[query.View]
+	if !exists {
+		data = served[""]
+	}
+	servedMutex.RUnlock()
+	return data.respond(query)
+}
+
+// RFC 5155, section 4.2. Only SHA-1 (algorithm 1) is defined.
+func readNSEC3PARAM(rdata []byte) (*nsec3Parameters, os.Error) {
+	if len(rdata) < 5 || len(rdata) < 5+int(rdata[4]) {
+		return nil, os.NewError("record too short")
+	}
+	if rdata[0] != 1 {
+		return nil, os.NewError(fmt.Sprintf("unsupported hash algorithm %d", rdata[0]))
+	}
+	return &nsec3Parameters{salt: rdata[5 : 5+int(rdata[4])],
+		iterations: uint16(rdata[2])<<8 | uint16(rdata[3])}, nil
+}
+
+var (
+	zonefileName, origin string
+	viewFiles            map[string]string // Zone file of each view, from -viewzonefiles
+	ksk, zsk             *dnssec.Key       // nil if we do not sign on the fly
+	validity             int64
+)
+
+// Reads a zone file and prepares its DNSSEC data
+func loadZone(filename string) (*zoneData, os.Error) {
+	newzone, error := zonefile.Read(filename, origin)
+	if error != nil {
+		return nil, error
+	}
+	data := &zoneData{zone: newzone}
+	if newzone.Signed() {
+		if ksk != nil {
+			return nil, os.NewError("the zone is already signed, -ksk cannot be used")
+		}
+		rrsets, _ := newzone.Find(newzone.Origin)
+		if rrsets[types.NSEC3PARAM] != nil {
+			data.nsec3, error = readNSEC3PARAM(rrsets[types.NSEC3PARAM][0].Data)
+			if error != nil {
+				return nil, os.NewError("invalid NSEC3PARAM: " + error.String())
+			}
+		}
+	} else if ksk != nil {
+		// A new signer, since the signatures of the old data are obsolete
+		data.signer = dnssec.NewSigner(newzone.Origin, ksk, zsk, validity)
+		for _, dnskey := range data.signer.DNSKEYs(defaultTTL) {
+			newzone.Add(dnskey)
+		}
+	}
+	return data, nil
+}
+
+// Reads all the zone files. The current data is replaced only if
+// everything is fine.
+func loadZones() os.Error {
+	newserved := make(map[string]*zoneData)
+	var error os.Error
+	newserved[""], error = loadZone(zonefileName)
+	if error != nil {
+		return error
+	}
+	for view, filename := range viewFiles {
+		newserved[view], error = loadZone(filename)
+		if error != nil {
+			return os.NewError(fmt.Sprintf("view %s: %s", view, error))
+		}
+	}
+	servedMutex.Lock()
+	served = newserved
+	servedMutex.Unlock()
+	return nil
+}
+
+// Reads the zone files again. If it fails, we keep serving the old
+// data.
+func Reload() {
+	error := loadZones()
+	if error != nil {
+		fmt.Fprintf(os.Stderr, "Cannot reload the zones, keeping the old ones: %s\n", error)
+	}
+}
+
+func Init(firstoption int) {
+	flag.Reinit(firstoption)
+	helpptr := flag.Bool("help", false, "Displays usage instructions")
+	zonefileptr := flag.String("zonefile", "", "Set the zone file to serve (mandatory)")
+	viewzonefilesptr := flag.String("viewzonefiles", "",
+		"Set the zone files of the views, for instance \"internal=internal.zone,lab=lab.zone\" (default: -zonefile for every view)")
+	originptr := flag.String("origin", "", "Set the origin for the relative names before any $ORIGIN")
+	kskptr := flag.String("ksk", "", "Set the private key (BIND format) to sign the DNSKEY set")
+	zskptr := flag.String("zsk", "", "Set the private key (BIND format) to sign the other sets (default: the KSK)")
+	validityptr := flag.Int("validity", 7, "Set the validity period of the signatures, in days")
+	flag.Parse()
+	help := *helpptr
+	if help {
+		fmt.Printf("Usage of the zone responder:\n")
+		flag.PrintDefaults()
+		os.Exit(0)
+	}
+	if *zonefileptr == "" {
+		fmt.Fprintf(os.Stderr, "The zone responder needs a -zonefile option\n")
+		os.Exit(1)
+	}
+	zonefileName = *zonefileptr
+	origin = *originptr
+	viewFiles = make(map[string]string)
+	if *viewzonefilesptr != "" {
+		for _, item := range strings.Split(*viewzonefilesptr, ",", -1) {
+			equal := strings.Index(item, "=")
+			if equal <= 0 {
+				fmt.Fprintf(os.Stderr, "Invalid item \"%s\" in -viewzonefiles\n", item)
+				os.Exit(1)
+			}
+			viewFiles[item[0:equal]] = item[equal+1:]
+		}
+	}
+	validity = int64(*validityptr) * 86400
+	if *zskptr != "" && *kskptr == "" {
+		// Otherwise, the ZSK would be silently ignored and the zone
+		// served unsigned
+		fmt.Fprintf(os.Stderr, "-zsk needs -ksk\n")
+		os.Exit(1)
+	}
+	var error os.Error
+	if *kskptr != "" {
+		ksk, error = dnssec.ReadKey(*kskptr, dnssec.KSKflags)
+		if error != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read the KSK: %s\n", error)
+			os.Exit(1)
+		}
+		zsk = ksk
+		if *zskptr != "" {
+			zsk, error = dnssec.ReadKey(*zskptr, dnssec.ZSKflags)
+			if error != nil {
+				fmt.Fprintf(os.Stderr, "Cannot read the ZSK: %s\n", error)
+				os.Exit(1)
+			}
+		}
+	}
+	error = loadZones()
+	if error != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read the zones: %s\n", error)
+		os.Exit(1)
+	}
+}
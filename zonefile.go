@@ -0,0 +1,885 @@
+/* Reading of zone files, in the master file format of RFC 1035,
+   section 5, and storage of their data for the responders.
+
+   Only a subset of the format is supported: $ORIGIN and $TTL (no
+   $INCLUDE), only the IN class, no escapes in domain names, no
+   multi-line strings.
+
+   Stephane Bortzmeyer <stephane+grong@bortzmeyer.org>
+*/
+
+package zonefile
+
+import (
+	"bytes"
+	"container/vector"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"./dnssec"
+	"./types"
+)
+
+const defaultTTL = 3600
+
+var typeCodes = map[string]uint16{
+	"A":     types.A,
+	"NS":    types.NS,
+	"CNAME": types.CNAME,
+	"SOA":   types.SOA,
+	"PTR":   types.PTR,
+	"MX":    types.MX,
+	"TXT":   types.TXT,
+	"AAAA":  types.AAAA,
+	"SRV":   types.SRV,
+	// DNSSEC, for the zones signed beforehand
+	"DS":         types.DS,
+	"RRSIG":      types.RRSIG,
+	"NSEC":       types.NSEC,
+	"DNSKEY":     types.DNSKEY,
+	"NSEC3":      types.NSEC3,
+	"NSEC3PARAM": types.NSEC3PARAM,
+}
+
+// Types we cannot parse but which may appear in the type bit maps of
+// NSEC and NSEC3 records (and which can be loaded with the generic
+// syntax of RFC 3597)
+var otherTypes = map[string]uint16{
+	"HINFO":   types.HINFO,
+	"LOC":     29,
+	"NAPTR":   35,
+	"DNAME":   39,
+	"SSHFP":   44,
+	"TLSA":    52,
+	"CDS":     59,
+	"CDNSKEY": 60,
+	"ZONEMD":  63,
+	"SVCB":    64,
+	"HTTPS":   65,
+	"SPF":     99,
+	"CAA":     257,
+}
+
+// The data of a zone, indexed by name then by type. All the names are
+// in lowercase and without the final dot, like the Qname of a
+// DNSquery.
+type Zone struct {
+	Origin string
+	SOA    types.RR
+	names  map[string]map[uint16][]types.RR
+	hashed map[string]map[uint16][]types.RR // NSEC3 records and their signatures
+	cuts   map[string]bool                  // Delegation points
+	sorted map[uint16][]string
+	mutex  sync.Mutex // Protects sorted, which is built when needed
+}
+
+// A line, after joining the lines inside parenthesis and removing the
+// comments
+type logicalLine struct {
+	number       int // Of the first physical line
+	ownerOmitted bool
+	tokens       []string
+}
+
+func tokenize(filename string, content string) (lines *vector.Vector, error os.Error) {
+	lines = new(vector.Vector)
+	tokens := new(vector.StringVector)
+	depth := 0
+	first := 0
+	ownerOmitted := false
+	for linenum, line := range strings.Split(content, "\n", -1) {
+		if depth == 0 {
+			first = linenum + 1
+			ownerOmitted = len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+		}
+		j := 0
+		for j < len(line) {
+			c := line[j]
+			switch {
+			case c == ';':
+				j = len(line)
+			case c == ' ' || c == '\t' || c == '\r':
+				j++
+			case c == '(':
+				depth++
+				j++
+			case c == ')':
+				depth--
+				if depth < 0 {
+					return nil, os.NewError(fmt.Sprintf("%s:%d: unbalanced parenthesis",
+						filename, linenum+1))
+				}
+				j++
+			case c == '"':
+				k := j + 1
+				for k < len(line) && line[k] != '"' {
+					if line[k] == '\\' {
+						k++
+					}
+					k++
+				}
+				if k >= len(line) {
+					return nil, os.NewError(fmt.Sprintf("%s:%d: unterminated string",
+						filename, linenum+1))
+				}
+				tokens.Push(line[j : k+1])
+				j = k + 1
+			default:
+				k := j
+				for k < len(line) && strings.Index(" \t\r;()\"", line[k:k+1]) == -1 {
+					if line[k] == '\\' {
+						k++
+					}
+					k++
+				}
+				if k > len(line) {
+					k = len(line)
+				}
+				tokens.Push(line[j:k])
+				j = k
+			}
+		}
+		if depth == 0 && tokens.Len() > 0 {
+			lines.Push(logicalLine{number: first, ownerOmitted: ownerOmitted,
+				tokens: []string(tokens.Copy())})
+			tokens = new(vector.StringVector)
+		}
+	}
+	if depth != 0 {
+		return nil, os.NewError(fmt.Sprintf("%s: unbalanced parenthesis at the end of file",
+			filename))
+	}
+	return lines, nil
+}
+
+// Turns a name from the zone file into the format we use internally
+func absolute(name string, origin string) (string, bool) {
+	name = strings.ToLower(name)
+	switch {
+	case name == "@":
+		return origin, origin != ""
+	case name == ".":
+		return ".", true
+	case name[len(name)-1] == '.':
+		return name[0 : len(name)-1], true
+	case origin == "":
+		return "", false
+	case origin == ".":
+		return name, true
+	}
+	return name + "." + origin, true
+}
+
+// types.Encode refuses these names, so we must refuse them first
+func invalidName(name string) os.Error {
+	return os.NewError(fmt.Sprintf("invalid name %s (empty label, label of more than 63 bytes or name too long)",
+		name))
+}
+
+func isNumber(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+// Removes the quotes and processes the escapes of a character string
+func unquote(s string) (string, bool) {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	result := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' {
+			i++
+			if i >= len(s) {
+				return "", false
+			}
+			if i+2 < len(s) && isNumber(s[i:i+3]) {
+				value, error := strconv.Atoui(s[i : i+3])
+				if error != nil || value > 255 {
+					return "", false
+				}
+				c = byte(value)
+				i += 2
+			} else {
+				c = s[i]
+			}
+		}
+		result = result[0 : len(result)+1]
+		result[len(result)-1] = c
+	}
+	return string(result), true
+}
+
+func putShort(i uint16) []byte {
+	result := make([]byte, 2)
+	binary.BigEndian.PutUint16(result, i)
+	return result
+}
+
+func parseShort(s string) (uint16, os.Error) {
+	value, error := strconv.Atoui(s)
+	if error != nil {
+		return 0, error
+	}
+	if value > 65535 {
+		return 0, os.NewError(fmt.Sprintf("%s is too large for 16 bits", s))
+	}
+	return uint16(value), nil
+}
+
+func parseByte(s string) (byte, os.Error) {
+	value, error := strconv.Atoui(s)
+	if error != nil {
+		return 0, error
+	}
+	if value > 255 {
+		return 0, os.NewError(fmt.Sprintf("%s is too large for 8 bits", s))
+	}
+	return byte(value), nil
+}
+
+// Type mnemonics, including the TYPEnnn syntax of RFC 3597, section 5
+func parseType(s string) (rrtype uint16, known bool) {
+	s = strings.ToUpper(s)
+	rrtype, known = typeCodes[s]
+	if known {
+		return
+	}
+	rrtype, known = otherTypes[s]
+	if known {
+		return
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		value, error := parseShort(s[4:])
+		return value, error == nil
+	}
+	return 0, false
+}
+
+// The time of RRSIG records, RFC 4034, section 3.2
+func parseTime(s string) (uint32, os.Error) {
+	if len(s) == 14 && isNumber(s) {
+		t := new(time.Time)
+		fields := []int{0, 4, 6, 8, 10, 12, 14}
+		values := make([]int, 6)
+		for i := 0; i < 6; i++ {
+			value, _ := strconv.Atoi(s[fields[i]:fields[i+1]])
+			values[i] = value
+		}
+		t.Year = int64(values[0])
+		t.Month, t.Day, t.Hour, t.Minute, t.Second = values[1], values[2], values[3], values[4], values[5]
+		return uint32(t.Seconds()), nil
+	}
+	value, error := strconv.Atoui64(s)
+	if error != nil || value > 0xFFFFFFFF {
+		return 0, os.NewError(fmt.Sprintf("invalid time %s", s))
+	}
+	return uint32(value), nil
+}
+
+func parseBase64(fields []string) ([]byte, os.Error) {
+	encoded := strings.Join(fields, "")
+	result := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, error := base64.StdEncoding.Decode(result, []byte(encoded))
+	if error != nil {
+		return nil, error
+	}
+	return result[0:n], nil
+}
+
+// The type bit maps of NSEC and NSEC3
+func parseBitmap(fields []string) ([]byte, os.Error) {
+	rrtypes := make([]uint16, len(fields))
+	for i, field := range fields {
+		rrtype, known := parseType(field)
+		if !known {
+			return nil, os.NewError(fmt.Sprintf("unknown type %s", field))
+		}
+		rrtypes[i] = rrtype
+	}
+	return dnssec.TypeBitmap(rrtypes), nil
+}
+
+// The salt of NSEC3 and NSEC3PARAM, with its length
+func parseSalt(s string) ([]byte, os.Error) {
+	if s == "-" {
+		return []byte{0}, nil
+	}
+	salt, error := hex.DecodeString(s)
+	if error != nil || len(salt) > 255 {
+		return nil, os.NewError(fmt.Sprintf("invalid salt %s", s))
+	}
+	return bytes.Add([]byte{byte(len(salt))}, salt), nil
+}
+
+// The parameters of NSEC3 and NSEC3PARAM: hash algorithm, flags,
+// iterations and salt
+func parseNSEC3Parameters(fields []string) (rdata []byte, error os.Error) {
+	rdata = make([]byte, 2)
+	for i := 0; i < 2; i++ {
+		rdata[i], error = parseByte(fields[i])
+		if error != nil {
+			return nil, error
+		}
+	}
+	iterations, error := parseShort(fields[2])
+	if error != nil {
+		return nil, error
+	}
+	salt, error := parseSalt(fields[3])
+	if error != nil {
+		return nil, error
+	}
+	return bytes.Add(bytes.Add(rdata, putShort(iterations)), salt), nil
+}
+
+// Encodes the RDATA in wire format. Domain names in the RDATA are put
+// in lowercase, as required by the canonical form of RFC 4034, section
+// 6.2.
+func encodeRdata(rrtype uint16, fields []string, origin string) (rdata []byte, error os.Error) {
+	nfields := map[uint16]int{types.A: 1, types.AAAA: 1, types.NS: 1,
+		types.CNAME: 1, types.PTR: 1, types.MX: 2, types.SOA: 7, types.SRV: 4}
+	minfields := map[uint16]int{types.DS: 4, types.DNSKEY: 4, types.RRSIG: 9,
+		types.NSEC: 1, types.NSEC3: 5, types.NSEC3PARAM: 4}
+	expected, fixed := nfields[rrtype]
+	if len(fields) > 0 && fields[0] == "\\#" {
+		// Generic syntax, RFC 3597, section 5
+		if len(fields) < 2 {
+			return nil, os.NewError("no length in generic RDATA")
+		}
+		length, error := parseShort(fields[1])
+		if error != nil {
+			return nil, error
+		}
+		rdata, error = hex.DecodeString(strings.Join(fields[2:], ""))
+		if error != nil || len(rdata) != int(length) {
+			return nil, os.NewError("invalid generic RDATA")
+		}
+		return rdata, nil
+	}
+	if fixed && len(fields) != expected {
+		return nil, os.NewError(fmt.Sprintf("%d fields expected, got %d", expected, len(fields)))
+	}
+	minimum, variable := minfields[rrtype]
+	if variable && len(fields) < minimum {
+		return nil, os.NewError(fmt.Sprintf("at least %d fields expected, got %d", minimum, len(fields)))
+	}
+	if len(fields) == 0 {
+		return nil, os.NewError("no RDATA")
+	}
+	name := func(s string) ([]byte, os.Error) {
+		result, ok := absolute(s, origin)
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("relative name %s without origin", s))
+		}
+		if !types.ValidName(result) {
+			return nil, invalidName(result)
+		}
+		return types.Encode(result), nil
+	}
+	switch rrtype {
+	case types.A:
+		address := net.ParseIP(fields[0])
+		if address == nil || address.To4() == nil {
+			return nil, os.NewError(fmt.Sprintf("invalid IPv4 address %s", fields[0]))
+		}
+		return address.To4(), nil
+	case types.AAAA:
+		address := net.ParseIP(fields[0])
+		if address == nil || address.To4() != nil {
+			return nil, os.NewError(fmt.Sprintf("invalid IPv6 address %s", fields[0]))
+		}
+		return address.To16(), nil
+	case types.NS, types.CNAME, types.PTR:
+		return name(fields[0])
+	case types.MX:
+		preference, error := parseShort(fields[0])
+		if error != nil {
+			return nil, error
+		}
+		exchange, error := name(fields[1])
+		if error != nil {
+			return nil, error
+		}
+		return bytes.Add(putShort(preference), exchange), nil
+	case types.SRV:
+		rdata = make([]byte, 0)
+		for i := 0; i < 3; i++ {
+			value, error := parseShort(fields[i])
+			if error != nil {
+				return nil, error
+			}
+			rdata = bytes.Add(rdata, putShort(value))
+		}
+		target, error := name(fields[3])
+		if error != nil {
+			return nil, error
+		}
+		return bytes.Add(rdata, target), nil
+	case types.TXT:
+		rdata = make([]byte, 0)
+		for _, field := range fields {
+			text, ok := unquote(field)
+			if !ok || len(text) > 255 {
+				return nil, os.NewError(fmt.Sprintf("invalid character string %s", field))
+			}
+			rdata = bytes.Add(rdata, types.ToTXT(text))
+		}
+		return rdata, nil
+	case types.SOA:
+		var soa types.SOArecord
+		var ok bool
+		soa.Mname, ok = absolute(fields[0], origin)
+		if !ok {
+			return nil, os.NewError("relative MNAME without origin")
+		}
+		soa.Rname, ok = absolute(fields[1], origin)
+		if !ok {
+			return nil, os.NewError("relative RNAME without origin")
+		}
+		if !types.ValidName(soa.Mname) {
+			return nil, invalidName(soa.Mname)
+		}
+		if !types.ValidName(soa.Rname) {
+			return nil, invalidName(soa.Rname)
+		}
+		values := make([]uint32, 5)
+		for i := 0; i < 5; i++ {
+			value, error := strconv.Atoui64(fields[2+i])
+			if error != nil || value > 0xFFFFFFFF {
+				return nil, os.NewError(fmt.Sprintf("invalid SOA value %s", fields[2+i]))
+			}
+			values[i] = uint32(value)
+		}
+		soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum =
+			values[0], values[1], values[2], values[3], values[4]
+		return types.EncodeSOA(soa), nil
+	case types.DNSKEY:
+		flags, error := parseShort(fields[0])
+		if error != nil {
+			return nil, error
+		}
+		rdata = putShort(flags)
+		for i := 1; i < 3; i++ { // Protocol and algorithm
+			value, error := parseByte(fields[i])
+			if error != nil {
+				return nil, error
+			}
+			rdata = bytes.AddByte(rdata, value)
+		}
+		key, error := parseBase64(fields[3:])
+		if error != nil {
+			return nil, error
+		}
+		return bytes.Add(rdata, key), nil
+	case types.DS:
+		keytag, error := parseShort(fields[0])
+		if error != nil {
+			return nil, error
+		}
+		rdata = putShort(keytag)
+		for i := 1; i < 3; i++ { // Algorithm and digest type
+			value, error := parseByte(fields[i])
+			if error != nil {
+				return nil, error
+			}
+			rdata = bytes.AddByte(rdata, value)
+		}
+		digest, error := hex.DecodeString(strings.Join(fields[3:], ""))
+		if error != nil {
+			return nil, error
+		}
+		return bytes.Add(rdata, digest), nil
+	case types.RRSIG:
+		covered, known := parseType(fields[0])
+		if !known {
+			return nil, os.NewError(fmt.Sprintf("unknown type %s", fields[0]))
+		}
+		rdata = putShort(covered)
+		for i := 1; i < 3; i++ { // Algorithm and labels
+			value, error := parseByte(fields[i])
+			if error != nil {
+				return nil, error
+			}
+			rdata = bytes.AddByte(rdata, value)
+		}
+		for i := 3; i < 6; i++ { // Original TTL, expiration, inception
+			var value uint32
+			var error os.Error
+			if i == 3 {
+				var value64 uint64
+				value64, error = strconv.Atoui64(fields[i])
+				if value64 > 0xFFFFFFFF {
+					error = os.NewError(fmt.Sprintf("invalid TTL %s", fields[i]))
+				}
+				value = uint32(value64)
+			} else {
+				value, error = parseTime(fields[i])
+			}
+			if error != nil {
+				return nil, error
+			}
+			temp := make([]byte, 4)
+			binary.BigEndian.PutUint32(temp, value)
+			rdata = bytes.Add(rdata, temp)
+		}
+		keytag, error := parseShort(fields[6])
+		if error != nil {
+			return nil, error
+		}
+		rdata = bytes.Add(rdata, putShort(keytag))
+		signer, error := name(fields[7])
+		if error != nil {
+			return nil, error
+		}
+		rdata = bytes.Add(rdata, signer)
+		signature, error := parseBase64(fields[8:])
+		if error != nil {
+			return nil, error
+		}
+		return bytes.Add(rdata, signature), nil
+	case types.NSEC:
+		next, error := name(fields[0])
+		if error != nil {
+			return nil, error
+		}
+		bitmap, error := parseBitmap(fields[1:])
+		if error != nil {
+			return nil, error
+		}
+		return bytes.Add(next, bitmap), nil
+	case types.NSEC3:
+		rdata, error = parseNSEC3Parameters(fields[0:4])
+		if error != nil {
+			return nil, error
+		}
+		next, ok := dnssec.DecodeBase32hex(fields[4])
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("invalid next hashed owner name %s", fields[4]))
+		}
+		rdata = bytes.AddByte(rdata, byte(len(next)))
+		rdata = bytes.Add(rdata, next)
+		bitmap, error := parseBitmap(fields[5:])
+		if error != nil {
+			return nil, error
+		}
+		return bytes.Add(rdata, bitmap), nil
+	case types.NSEC3PARAM:
+		return parseNSEC3Parameters(fields)
+	}
+	return nil, os.NewError(fmt.Sprintf("unsupported type %d", rrtype))
+}
+
+func parseRecords(filename string, content string, origin string) (records *vector.Vector, error os.Error) {
+	records = new(vector.Vector)
+	lines, error := tokenize(filename, content)
+	if error != nil {
+		return nil, error
+	}
+	ttl := uint32(defaultTTL)
+	owner := ""
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i).(logicalLine)
+		tokens := line.tokens
+		fail := func(msg string) os.Error {
+			return os.NewError(fmt.Sprintf("%s:%d: %s", filename, line.number, msg))
+		}
+		if tokens[0][0] == '$' {
+			if len(tokens) != 2 {
+				return nil, fail(fmt.Sprintf("%s needs one argument", tokens[0]))
+			}
+			switch strings.ToUpper(tokens[0]) {
+			case "$ORIGIN":
+				var ok bool
+				origin, ok = absolute(tokens[1], origin)
+				if !ok {
+					return nil, fail("relative $ORIGIN without a previous origin")
+				}
+			case "$TTL":
+				value, error := strconv.Atoui64(tokens[1])
+				if error != nil || value > 0x7FFFFFFF {
+					return nil, fail(fmt.Sprintf("invalid TTL %s", tokens[1]))
+				}
+				ttl = uint32(value)
+			default:
+				return nil, fail(fmt.Sprintf("unsupported directive %s", tokens[0]))
+			}
+			continue
+		}
+		if !line.ownerOmitted {
+			var ok bool
+			owner, ok = absolute(tokens[0], origin)
+			if !ok {
+				return nil, fail(fmt.Sprintf("relative name %s without origin", tokens[0]))
+			}
+			if !types.ValidName(owner) {
+				return nil, fail(invalidName(owner).String())
+			}
+			tokens = tokens[1:]
+		} else if owner == "" {
+			return nil, fail("no owner name")
+		}
+		rr := types.RR{Name: owner, Class: types.IN, TTL: ttl}
+		found := false
+		for !found && len(tokens) > 0 {
+			token := strings.ToUpper(tokens[0])
+			tokens = tokens[1:]
+			switch {
+			case isNumber(token):
+				value, error := strconv.Atoui64(token)
+				if error != nil || value > 0x7FFFFFFF {
+					return nil, fail(fmt.Sprintf("invalid TTL %s", token))
+				}
+				rr.TTL = uint32(value)
+			case token == "IN":
+				// Nothing to do
+			case token == "CH" || token == "HS" || token == "CS":
+				return nil, fail(fmt.Sprintf("unsupported class %s", token))
+			default:
+				rrtype, known := parseType(token)
+				_, parsable := typeCodes[token]
+				if !known || (!parsable && (len(tokens) == 0 || tokens[0] != "\\#")) {
+					return nil, fail(fmt.Sprintf("unsupported type %s", token))
+				}
+				rr.Type = rrtype
+				found = true
+			}
+		}
+		if !found {
+			return nil, fail("no type")
+		}
+		rr.Data, error = encodeRdata(rr.Type, tokens, origin)
+		if error != nil {
+			return nil, fail(error.String())
+		}
+		records.Push(rr)
+	}
+	return records, nil
+}
+
+// Returns the name without its first label
+func Parent(name string) string {
+	dot := strings.Index(name, ".")
+	if dot == -1 || name == "." {
+		return "."
+	}
+	return name[dot+1:]
+}
+
+// Reads a zone file. origin is used for the relative names until a
+// $ORIGIN is found, it can be empty. The zone's name is the owner
+// name of the SOA record, which must be unique.
+func Read(filename string, origin string) (zone *Zone, error os.Error) {
+	content, error := ioutil.ReadFile(filename)
+	if error != nil {
+		return nil, error
+	}
+	if origin != "" && origin[len(origin)-1] != '.' {
+		origin, _ = absolute(origin+".", "")
+	}
+	records, error := parseRecords(filename, string(content), origin)
+	if error != nil {
+		return nil, error
+	}
+	zone = &Zone{names: make(map[string]map[uint16][]types.RR),
+		hashed: make(map[string]map[uint16][]types.RR),
+		cuts:   make(map[string]bool), sorted: make(map[uint16][]string)}
+	for i := 0; i < records.Len(); i++ {
+		rr := records.At(i).(types.RR)
+		if rr.Type == types.SOA {
+			if zone.Origin != "" {
+				return nil, os.NewError(fmt.Sprintf("%s: more than one SOA record", filename))
+			}
+			zone.Origin = rr.Name
+			zone.SOA = rr
+		}
+	}
+	if zone.Origin == "" {
+		return nil, os.NewError(fmt.Sprintf("%s: no SOA record", filename))
+	}
+	for i := 0; i < records.Len(); i++ {
+		rr := records.At(i).(types.RR)
+		if !zone.Contains(rr.Name) {
+			return nil, os.NewError(fmt.Sprintf("%s: %s is out of zone %s", filename,
+				rr.Name, zone.Origin))
+		}
+		zone.Add(rr)
+	}
+	return zone, nil
+}
+
+// Tells if the name is at or under the apex of the zone
+func (zone *Zone) Contains(name string) bool {
+	return zone.Origin == "." || name == zone.Origin ||
+		strings.HasSuffix(name, "."+zone.Origin)
+}
+
+// The owner names of the NSEC3 records are hashes, not names of the
+// zone (RFC 5155, section 7.2): they are kept apart, with their
+// signatures, so they are only used for the denial of existence.
+func (zone *Zone) table(rrtype uint16) map[string]map[uint16][]types.RR {
+	if rrtype == types.NSEC3 {
+		return zone.hashed
+	}
+	return zone.names
+}
+
+// The type of the record or, for a RRSIG, the type it covers
+func covered(rr types.RR) uint16 {
+	if rr.Type == types.RRSIG && len(rr.Data) >= 2 {
+		return binary.BigEndian.Uint16(rr.Data[0:2])
+	}
+	return rr.Type
+}
+
+// Adds a record to the zone. The name must be in the zone.
+func (zone *Zone) Add(rr types.RR) {
+	table := zone.table(covered(rr))
+	rrsets, exists := table[rr.Name]
+	if !exists {
+		rrsets = make(map[uint16][]types.RR)
+		table[rr.Name] = rrsets
+	}
+	rrset := rrsets[rr.Type]
+	for _, old := range rrset {
+		if bytes.Equal(old.Data, rr.Data) { // Duplicates are ignored
+			return
+		}
+	}
+	newrrset := make([]types.RR, len(rrset)+1)
+	copy(newrrset, rrset)
+	newrrset[len(rrset)] = rr
+	rrsets[rr.Type] = newrrset
+	zone.mutex.Lock()
+	zone.sorted[rr.Type] = nil, false
+	zone.mutex.Unlock()
+	if table != zone.names {
+		return
+	}
+	if rr.Type == types.NS && rr.Name != zone.Origin {
+		zone.cuts[rr.Name] = true
+	}
+	// The empty non-terminals exist, too
+	for name := rr.Name; name != zone.Origin && name != "."; {
+		name = Parent(name)
+		_, exists := zone.names[name]
+		if !exists {
+			zone.names[name] = make(map[uint16][]types.RR)
+		}
+	}
+}
+
+// Returns the RRsets of a name. The name may exist without any RRset
+// (empty non-terminal).
+func (zone *Zone) Find(name string) (rrsets map[uint16][]types.RR, exists bool) {
+	rrsets, exists = zone.names[name]
+	return
+}
+
+// Returns the NSEC or NSEC3 RRset at this name, nil if there is none
+func (zone *Zone) FindDenial(name string, rrtype uint16) []types.RR {
+	return zone.table(rrtype)[name][rrtype]
+}
+
+// Tells if the name is at or under a zone cut (a delegation to
+// another zone) and returns the name of the cut.
+func (zone *Zone) Delegation(name string) (cut string, found bool) {
+	for cut = name; cut != zone.Origin && cut != "."; cut = Parent(cut) {
+		if zone.cuts[cut] {
+			return cut, true
+		}
+	}
+	return "", false
+}
+
+// The TTL of negative answers, RFC 2308, section 5
+func (zone *Zone) NegativeTTL() uint32 {
+	minimum := binary.BigEndian.Uint32(zone.SOA.Data[len(zone.SOA.Data)-4:])
+	if zone.SOA.TTL < minimum {
+		return zone.SOA.TTL
+	}
+	return minimum
+}
+
+// Tells if the zone has been signed beforehand
+func (zone *Zone) Signed() bool {
+	return zone.names[zone.Origin][types.RRSIG] != nil
+}
+
+// Returns the RRSIG records of the RRset
+func (zone *Zone) Signatures(name string, rrtype uint16) (result []types.RR) {
+	rrsigs := zone.table(rrtype)[name][types.RRSIG]
+	result = make([]types.RR, 0, len(rrsigs))
+	for _, rrsig := range rrsigs {
+		if len(rrsig.Data) >= 2 && binary.BigEndian.Uint16(rrsig.Data[0:2]) == rrtype {
+			result = result[0 : len(result)+1]
+			result[len(result)-1] = rrsig
+		}
+	}
+	return
+}
+
+type canonicalNames []string
+
+func (names canonicalNames) Len() int { return len(names) }
+
+func (names canonicalNames) Less(i, j int) bool {
+	return dnssec.CanonicalCompare(names[i], names[j]) < 0
+}
+
+func (names canonicalNames) Swap(i, j int) { names[i], names[j] = names[j], names[i] }
+
+// Returns the names which have a record of this type, in the canonical
+// order
+func (zone *Zone) Sorted(rrtype uint16) []string {
+	zone.mutex.Lock()
+	defer zone.mutex.Unlock()
+	result, built := zone.sorted[rrtype]
+	if built {
+		return result
+	}
+	table := zone.table(rrtype)
+	result = make([]string, 0, len(table))
+	for name, rrsets := range table {
+		if rrsets[rrtype] != nil {
+			result = result[0 : len(result)+1]
+			result[len(result)-1] = name
+		}
+	}
+	sort.Sort(canonicalNames(result))
+	zone.sorted[rrtype] = result
+	return result
+}
+
+// Returns the last of the sorted names which is before (or equal to)
+// name in the canonical order. Since the NSEC and NSEC3 chains are
+// circular, it is the last name if name is before all of them.
+func Predecessor(sorted []string, name string) string {
+	low, high := 0, len(sorted)
+	for low < high { // Find the first one which is after name
+		middle := (low + high) / 2
+		if dnssec.CanonicalCompare(sorted[middle], name) <= 0 {
+			low = middle + 1
+		} else {
+			high = middle
+		}
+	}
+	if low == 0 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[low-1]
+}